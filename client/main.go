@@ -5,21 +5,26 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
 
 	"net/http"
 
 	"net/url"
 
+	"github.com/tsauvajon/go-microservices-poc/config"
 	"github.com/tsauvajon/go-microservices-poc/dataAccess"
 	"github.com/tsauvajon/go-microservices-poc/errorHandling"
 	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
 )
 
-const htmlPage = "<html><head><title>Upload file</title></head><body><form enctype=\"multipart/form-data\" action=\"submitTask\" method=\"post\"> <input type=\"file\" name=\"uploadfile\" /> <input type=\"submit\" value=\"upload\" /> </form> </body> </html>"
+const htmlPage = "<html><head><title>Upload file</title></head><body><form enctype=\"multipart/form-data\" action=\"submitTask\" method=\"post\"> <input type=\"file\" name=\"uploadfile\" /> <textarea name=\"spec\" placeholder=\"{&quot;operations&quot;: [{&quot;name&quot;: &quot;grayscale&quot;}]}\"></textarea> <input type=\"submit\" value=\"upload\" /> </form> </body> </html>"
 
 var (
 	keyValueStoreAddress string
 	masterLocation       string
+	// used for the requests that don't carry an X-API-Key header
+	defaultAPIKey = config.GetString("CLIENT_API_KEY", "")
 )
 
 func main() {
@@ -51,6 +56,34 @@ func main() {
 	http.ListenAndServe(":3334", nil)
 }
 
+// toMaster : sends a request to the master with the API key of the user
+func toMaster(r *http.Request, method, path string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, "http://"+masterLocation+path, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey := r.Header.Get(tenant.APIKeyHeader)
+
+	if len(apiKey) == 0 {
+		apiKey = defaultAPIKey
+	}
+
+	request.Header.Set(tenant.APIKeyHeader, apiKey)
+
+	return http.DefaultClient.Do(request)
+}
+
+// relayError : responds with the status and message of a failed request to the master, such as a 429
+func relayError(w http.ResponseWriter, response *http.Response) {
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(response.Body)
+
+	w.WriteHeader(response.StatusCode)
+	w.Write(data)
+}
+
 func handleIndex(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, htmlPage)
 }
@@ -78,16 +111,29 @@ func handleTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println("Posting the file to", "http://"+masterLocation+"/newImage")
+	path := "/newImage"
 
-	response, err := http.Post("http://"+masterLocation+"/newImage", "image", file)
+	// optional JSON task.Spec, which the master validates
+	if spec := r.FormValue("spec"); len(spec) != 0 {
+		path += "?spec=" + url.QueryEscape(spec)
+	}
 
-	if err != nil || response.StatusCode != http.StatusOK {
+	fmt.Println("Posting the file to", "http://"+masterLocation+path)
+
+	response, err := toMaster(r, http.MethodPost, path, file)
+
+	if err != nil {
 		fmt.Println("Error Posting the file")
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
+	if response.StatusCode != http.StatusOK {
+		fmt.Println("Error Posting the file")
+		relayError(w, response)
+		return
+	}
+
 	fmt.Println("Reading the response")
 
 	defer response.Body.Close()
@@ -117,18 +163,23 @@ func handleCheckForReadiness(w http.ResponseWriter, r *http.Request) {
 
 	id := values.Get("id")
 
-	if len(id) == 0 {
-		errorHandling.RespondWithError(w, "invalid ID")
+	if err = task.ValidateID(id); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	response, err := http.Get("http://" + masterLocation + "/isReady?id=" + id + "&state=finished")
+	response, err := toMaster(r, http.MethodGet, "/isReady?id="+id, nil)
 
-	if err != nil || response.StatusCode != http.StatusOK {
+	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
+	if response.StatusCode != http.StatusOK {
+		relayError(w, response)
+		return
+	}
+
 	defer response.Body.Close()
 	data, err := ioutil.ReadAll(response.Body)
 
@@ -139,10 +190,14 @@ func handleCheckForReadiness(w http.ResponseWriter, r *http.Request) {
 
 	// hashtag la flemme de faire ça correctement
 	switch string(data) {
-	case string(task.StatusInProgress):
+	case strconv.Itoa(task.StatusInProgress):
 		fmt.Fprint(w, "Your image is not ready yet")
-	case string(task.StatusFinished):
+	case strconv.Itoa(task.StatusFinished):
 		fmt.Fprint(w, "Your image is ready")
+	case strconv.Itoa(task.StatusFailed):
+		fmt.Fprint(w, "The work on your image failed")
+	case strconv.Itoa(task.StatusCancelled):
+		fmt.Fprint(w, "The work on your image was cancelled")
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, "Error: ", "wrong progression status")
@@ -164,18 +219,38 @@ func serveImage(w http.ResponseWriter, r *http.Request) {
 
 	id := values.Get("id")
 
-	if len(id) == 0 {
-		errorHandling.RespondWithError(w, "invalid ID")
+	if err = task.ValidateID(id); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	response, err := http.Get("http://" + masterLocation + "/get?id=" + id + "&state=finished")
+	path := "/getImage?id=" + id
+
+	// the result unless another image of the task is asked for, such as thumb-128 or original
+	if variant := values.Get("variant"); len(variant) != 0 {
+		if err = task.ValidateVariant(variant); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
 
-	if err != nil || response.StatusCode != http.StatusOK {
+		path += "&variant=" + variant
+	}
+
+	response, err := toMaster(r, http.MethodGet, path, nil)
+
+	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
+	if response.StatusCode != http.StatusOK {
+		relayError(w, response)
+		return
+	}
+
+	defer response.Body.Close()
+	w.Header().Set("Content-Type", response.Header.Get("Content-Type"))
+
 	_, err = io.Copy(w, response.Body)
 
 	if err != nil {
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// GetString : get an optional setting from the environment, or def if unset
+func GetString(key, def string) string {
+	value := os.Getenv(key)
+
+	if len(value) == 0 {
+		return def
+	}
+
+	return value
+}
+
+// GetInt : get an optional integer setting from the environment, or def if unset or invalid
+func GetInt(key string, def int) int {
+	value := os.Getenv(key)
+
+	if len(value) == 0 {
+		return def
+	}
+
+	parsed, err := strconv.Atoi(value)
+
+	if err != nil {
+		fmt.Println("Error: ", "invalid value for", key, err.Error())
+		return def
+	}
+
+	return parsed
+}
+
+// GetDuration : get an optional duration setting (e.g. "24h") from the environment, or def if unset or invalid
+func GetDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+
+	if len(value) == 0 {
+		return def
+	}
+
+	parsed, err := time.ParseDuration(value)
+
+	if err != nil {
+		fmt.Println("Error: ", "invalid value for", key, err.Error())
+		return def
+	}
+
+	return parsed
+}
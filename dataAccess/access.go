@@ -1,10 +1,12 @@
 package dataAccess
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 )
 
 // GetValue : get the value associated with a key
@@ -33,3 +35,68 @@ func GetValue(address, key string) (string, error) {
 
 	return string(data), nil
 }
+
+// ListValues : get every key starting with prefix, and its value
+func ListValues(address, prefix string) (map[string]string, error) {
+	response, err := http.Get("http://" + address + "/list?prefix=" + url.QueryEscape(prefix))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("Error: can't list the keys starting with " + prefix + ": " + string(data))
+	}
+
+	values := make(map[string]string)
+
+	if err = json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// SetValue : associate value with key
+func SetValue(address, key, value string) error {
+	_, err := setValue(address, url.Values{"key": {key}, "value": {value}})
+
+	return err
+}
+
+// CompareAndSet : associate value with key if its value is still previous ("" for a missing key), swapped is false otherwise
+func CompareAndSet(address, key, previous, value string) (swapped bool, err error) {
+	return setValue(address, url.Values{"key": {key}, "value": {value}, "ifValue": {previous}})
+}
+
+func setValue(address string, values url.Values) (bool, error) {
+	response, err := http.Post("http://"+address+"/set?"+values.Encode(), "", nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return false, err
+	}
+
+	if response.StatusCode == http.StatusConflict {
+		return false, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return false, errors.New("Error: can't set " + values.Get("key") + ": " + string(data))
+	}
+
+	return true, nil
+}
@@ -21,3 +21,10 @@ func RespondWithError(w http.ResponseWriter, reason string) {
 	w.WriteHeader(http.StatusBadRequest)
 	fmt.Fprint(w, "Error : ", reason)
 }
+
+// RespondWithStatus : Responds with an error given as a parameter, and an HTTP status other than bad request
+func RespondWithStatus(w http.ResponseWriter, status int, reason string) {
+	fmt.Println("Responding with", status, "because:", reason)
+	w.WriteHeader(status)
+	fmt.Fprint(w, "Error : ", reason)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+// ownerDirectory : images of a tenant are kept apart, so that no tenant can read another one's
+func ownerDirectory(owner string) string {
+	if len(owner) == 0 {
+		return storageDirectory
+	}
+
+	return filepath.Join(storageDirectory, "tenants", owner)
+}
+
+// imagesDirectory : the directories of the tasks of owner
+func imagesDirectory(owner string) string {
+	return filepath.Join(ownerDirectory(owner), "images")
+}
+
+// taskDirectory : the images of a task, a file for each variant
+func taskDirectory(owner, id string) string {
+	return filepath.Join(imagesDirectory(owner), id)
+}
+
+// overlayDirectory : the overlay images of owner, which its tasks stamp on their images
+func overlayDirectory(owner string) string {
+	return filepath.Join(ownerDirectory(owner), "overlays")
+}
+
+// findImage : the files stored for the image name of directory, whatever their content type
+func findImage(directory, name string) ([]string, error) {
+	// valid variant and overlay names have no glob metacharacter
+	return filepath.Glob(filepath.Join(directory, name+".*"))
+}
+
+// ownerParameter : the optional tenant owning the image, checked as it ends up in a file path
+func ownerParameter(values url.Values) (string, error) {
+	owner := values.Get("tenant")
+
+	if len(owner) == 0 {
+		return "", nil
+	}
+
+	return owner, tenant.ValidateID(owner)
+}
+
+// variantParameter : the variant of the image, checked as it ends up in a file path
+func variantParameter(values url.Values) (string, error) {
+	variant := values.Get("variant")
+
+	if len(variant) == 0 {
+		return "", errors.New("missing variant")
+	}
+
+	return variant, task.ValidateVariant(variant)
+}
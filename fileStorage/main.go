@@ -1,32 +1,45 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
 
+	"github.com/tsauvajon/go-microservices-poc/config"
 	"github.com/tsauvajon/go-microservices-poc/dataAccess"
 	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/imageProcessing"
+	"github.com/tsauvajon/go-microservices-poc/task"
 )
 
-const (
-	// StateWorking : currently working on this image
-	StateWorking = "working"
-	// StateFinished : finished the work on this image
-	StateFinished = "finished"
-)
+var storageDirectory string
 
 func main() {
 	if !dataAccess.RegisterInKeyValueStore("storageAddress") {
 		return
 	}
 
+	// use /tmp/ on Unix systems
+	storageDirectory = config.GetString("FILESTORAGE_DIRECTORY", "c:/tmp/")
+
 	http.HandleFunc("/sendImage", receiveImage)
 	http.HandleFunc("/getImage", serveImage)
+	http.HandleFunc("/listImages", listImages)
+	http.HandleFunc("/deleteImage", deleteImage)
+	http.HandleFunc("/sendOverlay", receiveOverlay)
+	http.HandleFunc("/getOverlay", serveOverlay)
+	http.HandleFunc("/listOverlays", listOverlays)
+	http.HandleFunc("/deleteOverlay", deleteOverlay)
+	http.HandleFunc("/usage", usage)
 	http.ListenAndServe(":3332", nil)
 }
 
@@ -47,37 +60,27 @@ func receiveImage(w http.ResponseWriter, r *http.Request) {
 
 	id := values.Get("id")
 
-	if len(id) == 0 {
-		errorHandling.RespondWithError(w, "invalid id")
-		return
-	}
-
-	state := values.Get("state")
-
-	if state != StateWorking && state != StateFinished {
-		errorHandling.RespondWithError(w, "invalid state")
+	if err = task.ValidateID(id); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	_, err = strconv.Atoi(id)
+	// original, result, or another image made by the task such as a thumbnail
+	variant, err := variantParameter(values)
 
 	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	// Change to /tmp/ on Unix systems
-	file, err := os.Create("c:/tmp/" + state + "/" + id + ".png")
-	defer file.Close()
+	owner, err := ownerParameter(values)
 
 	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	_, err = io.Copy(file, r.Body)
-
-	if err != nil {
+	if err = storeImage(taskDirectory(owner, id), variant, r.Body); err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
@@ -102,34 +105,114 @@ func serveImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the id ends up in a file path
 	id := values.Get("id")
 
-	if len(id) == 0 {
+	if err = task.ValidateID(id); err != nil {
 		fmt.Println("Invalid ID")
 		errorHandling.RespondWithError(w, "invalid ID")
 		return
 	}
 
-	state := values.Get("state")
+	variant, err := variantParameter(values)
 
-	if state != StateWorking && state != StateFinished {
-		fmt.Println("Invalid State")
-		errorHandling.RespondWithError(w, "invalid state")
+	if err != nil {
+		fmt.Println("Invalid Variant")
+		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	// we check that the id is a number
-	_, err = strconv.Atoi(id)
+	// another tenant's image is just not found
+	owner, err := ownerParameter(values)
 
 	if err != nil {
-		fmt.Println("Invalid ID")
+		fmt.Println("Invalid Tenant")
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	serveStored(w, taskDirectory(owner, id), variant, variant+" image of "+id)
+}
+
+// listImages : responds with the variants stored for a task, as task.Variant, sorted by name
+func listImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	id := values.Get("id")
+
+	if err = task.ValidateID(id); err != nil {
 		errorHandling.RespondWithError(w, "invalid ID")
 		return
 	}
 
-	// change to /tmp/ ... for Unix systems
-	file, err := os.Open("c:/tmp/" + state + "/" + id + ".png")
+	owner, err := ownerParameter(values)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	respondWithList(w, taskDirectory(owner, id))
+}
+
+// storeImage : writes body as the image name of directory, replacing it whatever its content type was
+func storeImage(directory, name string, body io.Reader) error {
+	// the content type is sniffed rather than trusted, a missing one is no reason to refuse an image
+	buffered := bufio.NewReaderSize(body, 512)
+	header, err := buffered.Peek(512)
+
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	path := filepath.Join(directory, name+imageProcessing.Extension(imageProcessing.SniffContentType(header)))
+
+	if err = os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+
+	// an image sent again may have another content type
+	if err = removeImage(directory, name, path); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
 	defer file.Close()
+	_, err = io.Copy(file, buffered)
+
+	return err
+}
+
+// serveStored : responds with the image name of directory and its content type, what it is tells which one is missing
+func serveStored(w http.ResponseWriter, directory, name, what string) {
+	paths, err := findImage(directory, name)
+
+	if err == nil && len(paths) == 0 {
+		err = errors.New("no " + what)
+	}
+
+	if err != nil {
+		fmt.Println("Error finding file:", err.Error())
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	file, err := os.Open(paths[0])
 
 	if err != nil {
 		fmt.Println("Error opening file:", err.Error())
@@ -137,6 +220,9 @@ func serveImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	defer file.Close()
+	w.Header().Set("Content-Type", imageProcessing.ContentTypeOf(filepath.Ext(paths[0])))
+
 	_, err = io.Copy(w, file)
 
 	if err != nil {
@@ -145,3 +231,39 @@ func serveImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// respondWithList : responds with the images of directory as task.Variant, sorted by name
+func respondWithList(w http.ResponseWriter, directory string) {
+	files, err := ioutil.ReadDir(directory)
+
+	// a directory is only made for the first image
+	if err != nil && !os.IsNotExist(err) {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	images := []task.Variant{}
+
+	for _, file := range files {
+		extension := filepath.Ext(file.Name())
+
+		if file.IsDir() {
+			continue
+		}
+
+		images = append(images, task.Variant{
+			Name:        strings.TrimSuffix(file.Name(), extension),
+			ContentType: imageProcessing.ContentTypeOf(extension),
+			Size:        file.Size(),
+		})
+	}
+
+	response, err := json.Marshal(images)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// overlayParameters : the owner and the name of the overlay, checked as they end up in a file path
+func overlayParameters(r *http.Request) (owner string, name string, err error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if owner, err = ownerParameter(values); err != nil {
+		return "", "", err
+	}
+
+	name = values.Get("name")
+
+	return owner, name, task.ValidateOverlay(name)
+}
+
+// receiveOverlay : stores an overlay image of a tenant, replacing the one with the same name
+func receiveOverlay(w http.ResponseWriter, r *http.Request) {
+	log.Println("receiveOverlay")
+
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	owner, name, err := overlayParameters(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	if err = storeImage(overlayDirectory(owner), name, r.Body); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, "Success")
+}
+
+func serveOverlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	owner, name, err := overlayParameters(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	serveStored(w, overlayDirectory(owner), name, "overlay "+name)
+}
+
+// listOverlays : responds with the overlay images of a tenant, as task.Variant, sorted by name
+func listOverlays(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	owner, err := ownerParameter(values)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	respondWithList(w, overlayDirectory(owner))
+}
+
+func deleteOverlay(w http.ResponseWriter, r *http.Request) {
+	log.Println("deleteOverlay")
+
+	if r.Method != http.MethodDelete {
+		errorHandling.RespondOnlyXAccepted(w, "DELETE")
+		return
+	}
+
+	owner, name, err := overlayParameters(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	if err = removeImage(overlayDirectory(owner), name, ""); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, "Success")
+}
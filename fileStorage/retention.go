@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+// deleteImage : removes every image of a task, or only its variant with the variant parameter
+func deleteImage(w http.ResponseWriter, r *http.Request) {
+	log.Println("deleteImage")
+
+	if r.Method != http.MethodDelete {
+		errorHandling.RespondOnlyXAccepted(w, "DELETE")
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	id := values.Get("id")
+
+	if err = task.ValidateID(id); err != nil {
+		errorHandling.RespondWithError(w, "invalid ID")
+		return
+	}
+
+	owner, err := ownerParameter(values)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	variant := ""
+
+	if len(values.Get("variant")) != 0 || len(values.Get("state")) != 0 {
+		if variant, err = variantParameter(values); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+	}
+
+	if len(variant) == 0 {
+		err = os.RemoveAll(taskDirectory(owner, id))
+	} else {
+		err = removeImage(taskDirectory(owner, id), variant, "")
+	}
+
+	if err != nil {
+		fmt.Println("Error removing file:", err.Error())
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, "Success")
+}
+
+// removeImage : removes the files of the image name of directory, except keep
+func removeImage(directory, name, keep string) error {
+	paths, err := findImage(directory, name)
+
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if path == keep {
+			continue
+		}
+
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addSizes : adds the bytes of the images of every task of owner to sizes, and those of its overlay images
+func addSizes(sizes map[string]int64, owner string) error {
+	overlays, err := ioutil.ReadDir(overlayDirectory(owner))
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, file := range overlays {
+		if !file.IsDir() {
+			sizes["overlays"] += file.Size()
+		}
+	}
+
+	tasks, err := ioutil.ReadDir(imagesDirectory(owner))
+
+	// the directory only exists once an image is stored
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, directory := range tasks {
+		if !directory.IsDir() || task.ValidateID(directory.Name()) != nil {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(imagesDirectory(owner), directory.Name()))
+
+		if err != nil {
+			return err
+		}
+
+		// a task with no image left still shows up, with 0 bytes
+		total := int64(0)
+
+		for _, file := range files {
+			if !file.IsDir() {
+				total += file.Size()
+			}
+		}
+
+		sizes[directory.Name()] += total
+	}
+
+	return nil
+}
+
+/*
+usage :
+Responds with the bytes stored for each task ID, all its variants included, and for the overlays,
+for a single tenant with the tenant parameter
+*/
+func usage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	owner, err := ownerParameter(values)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	owners := []string{owner}
+
+	if len(owner) == 0 {
+		tenants, err := ioutil.ReadDir(filepath.Join(storageDirectory, "tenants"))
+
+		if err != nil && !os.IsNotExist(err) {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+
+		for _, directory := range tenants {
+			if directory.IsDir() && tenant.ValidateID(directory.Name()) == nil {
+				owners = append(owners, directory.Name())
+			}
+		}
+	}
+
+	sizes := make(map[string]int64)
+
+	for _, owner := range owners {
+		if err = addSizes(sizes, owner); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+	}
+
+	response, err := json.Marshal(sizes)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
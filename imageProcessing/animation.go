@@ -0,0 +1,176 @@
+package imageProcessing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+/*
+Animation :
+The frames of an animated GIF, each one whole, as displayed, with the delay in hundredths
+of a second and the disposal method of the GIF frame it comes from.
+As an image.Image it is its first frame, the operations run on each frame
+*/
+type Animation struct {
+	Frames    []image.Image
+	Delays    []int
+	Disposals []byte
+	LoopCount int
+}
+
+// ColorModel : the color model of the first frame
+func (animation *Animation) ColorModel() color.Model {
+	return animation.Frames[0].ColorModel()
+}
+
+// Bounds : the bounds of the first frame, all frames have the same size
+func (animation *Animation) Bounds() image.Rectangle {
+	return animation.Frames[0].Bounds()
+}
+
+// At : the color of the first frame
+func (animation *Animation) At(x, y int) color.Color {
+	return animation.Frames[0].At(x, y)
+}
+
+// Still : the first frame of an animation, or img itself
+func Still(img image.Image) image.Image {
+	if animation, animated := img.(*Animation); animated {
+		return animation.Frames[0]
+	}
+
+	return img
+}
+
+/*
+decodeAnimation :
+The frames of a GIF image with more than one, composed over each other as its disposal
+methods tell, nil for any other image
+*/
+func decodeAnimation(data []byte) (*Animation, error) {
+	if SniffContentType(data) != "image/gif" {
+		return nil, nil
+	}
+
+	decoded, err := gif.DecodeAll(bytes.NewReader(data))
+
+	if err != nil || len(decoded.Image) < 2 {
+		return nil, err
+	}
+
+	animation := &Animation{
+		Frames:    make([]image.Image, len(decoded.Image)),
+		Delays:    decoded.Delay,
+		Disposals: decoded.Disposal,
+		LoopCount: decoded.LoopCount,
+	}
+
+	// what is displayed, before the disposal of the frame
+	canvas := image.NewNRGBA(image.Rect(0, 0, decoded.Config.Width, decoded.Config.Height))
+
+	for i, frame := range decoded.Image {
+		var previous []uint8
+
+		if decoded.Disposal[i] == gif.DisposalPrevious {
+			previous = append(previous, canvas.Pix...)
+		}
+
+		draw.Draw(canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+		animation.Frames[i] = toNRGBA(canvas)
+
+		switch decoded.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+
+	return animation, nil
+}
+
+/*
+eachFrame :
+The animation with apply run on each of its frames, from a pool of parallelism goroutines.
+Every frame has to come out with the same size, the first one is run alone to check that
+all of them fit within the ResultLimits
+*/
+func (animation *Animation) eachFrame(apply func(frame image.Image) (image.Image, error)) (*Animation, error) {
+	frames := make([]image.Image, len(animation.Frames))
+	errs := make([]error, len(animation.Frames))
+
+	if len(frames) == 0 {
+		return nil, errors.New("the animation has no frames")
+	}
+
+	if frames[0], errs[0] = apply(animation.Frames[0]); errs[0] != nil {
+		return nil, fmt.Errorf("frame 0: %s", errs[0].Error())
+	}
+
+	size := frames[0].Bounds().Size()
+
+	if pixels := int64(size.X) * int64(size.Y) * int64(len(frames)); pixels > ResultLimits.MaxPixels {
+		return nil, LimitError{fmt.Sprintf("%d frames of %dx%d pixels, over the limit of %d pixels", len(frames), size.X, size.Y, ResultLimits.MaxPixels)}
+	}
+
+	// the frames after the first one
+	parallelRows(len(frames)-1, func(first, last int) {
+		for i := first + 1; i <= last; i++ {
+			frames[i], errs[i] = apply(animation.Frames[i])
+		}
+	})
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %s", i, err.Error())
+		}
+
+		if frames[i].Bounds().Size() != size {
+			return nil, fmt.Errorf("frame %d: %v, the first frame is %v", i, frames[i].Bounds().Size(), size)
+		}
+	}
+
+	return &Animation{Frames: frames, Delays: animation.Delays, Disposals: animation.Disposals, LoopCount: animation.LoopCount}, nil
+}
+
+// the colors of the encoded frames: the Plan 9 palette, its last color giving way to transparency
+var animationPalette = append(append(color.Palette{}, palette.Plan9[:255]...), color.Transparent)
+
+/*
+encodeAnimation :
+Encodes every frame whole, with dithering, the mostly transparent pixels staying transparent.
+The frames keep their delays and disposal methods
+*/
+func encodeAnimation(w io.Writer, animation *Animation) error {
+	encoded := &gif.GIF{
+		Image:     make([]*image.Paletted, len(animation.Frames)),
+		Delay:     animation.Delays,
+		Disposal:  animation.Disposals,
+		LoopCount: animation.LoopCount,
+	}
+
+	parallelRows(len(animation.Frames), func(first, last int) {
+		for i := first; i < last; i++ {
+			frame := toNRGBA(animation.Frames[i])
+			paletted := image.NewPaletted(frame.Rect, animationPalette)
+			draw.FloydSteinberg.Draw(paletted, frame.Rect, frame, image.Point{})
+
+			for pixel := range paletted.Pix {
+				if frame.Pix[pixel*4+3] < 0x80 {
+					paletted.Pix[pixel] = uint8(len(animationPalette) - 1)
+				}
+			}
+
+			encoded.Image[i] = paletted
+		}
+	})
+
+	return gif.EncodeAll(w, encoded)
+}
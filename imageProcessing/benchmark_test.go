@@ -0,0 +1,140 @@
+package imageProcessing
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"runtime"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// the size of the images of the benchmarks
+const benchmarkWidth, benchmarkHeight = 2000, 1500
+
+// benchmarkSources : an image of each type decoders return, PNG decoding to NRGBA or RGBA, JPEG to YCbCr, 16 bit PNG to NRGBA64
+func benchmarkSources() []struct {
+	name string
+	img  image.Image
+} {
+	bounds := image.Rect(0, 0, benchmarkWidth, benchmarkHeight)
+
+	return []struct {
+		name string
+		img  image.Image
+	}{
+		{"RGBA", benchmarkPattern(image.NewRGBA(bounds))},
+		{"NRGBA", benchmarkPattern(image.NewNRGBA(bounds))},
+		{"YCbCr", benchmarkPattern(image.NewYCbCr(bounds, image.YCbCrSubsampleRatio420))},
+		{"NRGBA64", benchmarkPattern(image.NewNRGBA64(bounds))},
+	}
+}
+
+// benchmarkGoroutines : runs steps on img as a sub-benchmark with 1 goroutine, then with one per CPU when there are several
+func benchmarkGoroutines(b *testing.B, img image.Image, steps []task.Operation) {
+	defer SetParallelism(parallelism)
+	counts := []int{1}
+
+	if cpus := runtime.GOMAXPROCS(0); cpus > 1 {
+		counts = append(counts, cpus)
+	}
+
+	for _, goroutines := range counts {
+		b.Run(fmt.Sprintf("goroutines=%d", goroutines), func(b *testing.B) {
+			SetParallelism(goroutines)
+
+			for i := 0; i < b.N; i++ {
+				if _, err := Run(img, steps); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSwapRedGreen : the per-pixel implementation the worker used to have, then the operation
+func BenchmarkSwapRedGreen(b *testing.B) {
+	for _, source := range benchmarkSources() {
+		b.Run(source.name, func(b *testing.B) {
+			b.Run("perPixel", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					swapRedGreenPerPixel(source.img)
+				}
+			})
+
+			benchmarkGoroutines(b, source.img, []task.Operation{{Name: "swapRedGreen"}})
+		})
+	}
+}
+
+func BenchmarkOperations(b *testing.B) {
+	img := benchmarkPattern(image.NewRGBA(image.Rect(0, 0, benchmarkWidth, benchmarkHeight)))
+	operations := []struct {
+		name      string
+		operation task.Operation
+	}{
+		{"grayscale", task.Operation{Name: "grayscale"}},
+		{"sepia", task.Operation{Name: "sepia"}},
+		{"contrast", task.Operation{Name: "contrast", Params: map[string]interface{}{"amount": 20.0}}},
+		{"blur", task.Operation{Name: "blur", Params: map[string]interface{}{"radius": 2.0}}},
+		{"sharpen", task.Operation{Name: "sharpen"}},
+		{"resizeHalf", task.Operation{Name: "resize", Params: map[string]interface{}{"width": float64(benchmarkWidth / 2)}}},
+		{"resizeThumbnail", task.Operation{Name: "resize", Params: map[string]interface{}{"width": 256.0, "height": 256.0, "mode": "fit", "kernel": "lanczos"}}},
+		{"rotate", task.Operation{Name: "rotate", Params: map[string]interface{}{"angle": 90.0}}},
+		{"flip", task.Operation{Name: "flip"}},
+	}
+
+	for _, operation := range operations {
+		b.Run(operation.name, func(b *testing.B) {
+			benchmarkGoroutines(b, img, []task.Operation{operation.operation})
+		})
+	}
+}
+
+// benchmarkPattern : fills img with gradients, so that no operation gets a uniform image
+func benchmarkPattern(img image.Image) image.Image {
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		for i := range ycbcr.Y {
+			ycbcr.Y[i] = uint8(i)
+		}
+
+		for i := range ycbcr.Cb {
+			ycbcr.Cb[i], ycbcr.Cr[i] = uint8(i/3), uint8(i/7)
+		}
+
+		return img
+	}
+
+	canvas := img.(interface {
+		Set(x, y int, c color.Color)
+	})
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			canvas.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x + y), A: 255})
+		}
+	}
+
+	return img
+}
+
+// swapRedGreenPerPixel : the implementation the worker had, kept for the comparison
+func swapRedGreenPerPixel(img image.Image) image.Image {
+	canvas := image.NewRGBA(img.Bounds())
+
+	for i := 0; i < canvas.Rect.Max.X; i++ {
+		for j := 0; j < canvas.Rect.Max.Y; j++ {
+			r, g, b, a := img.At(i, j).RGBA()
+			color := new(color.RGBA)
+			color.R = uint8(g)
+			color.G = uint8(r)
+			color.B = uint8(b)
+			color.A = uint8(a)
+			canvas.Set(i, j, color)
+		}
+	}
+
+	return canvas.SubImage(img.Bounds())
+}
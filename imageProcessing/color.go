@@ -0,0 +1,75 @@
+package imageProcessing
+
+import (
+	"image"
+)
+
+func init() {
+	// the work done on the tasks without operations
+	Register(Operation{
+		Name: "swapRedGreen",
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				return g, r, b
+			}), nil
+		},
+	})
+
+	Register(Operation{
+		Name: "grayscale",
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				// ITU-R BT.601 luma
+				y := 0.299*r + 0.587*g + 0.114*b
+
+				return y, y, y
+			}), nil
+		},
+	})
+
+	Register(Operation{
+		Name: "invert",
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				return 255 - r, 255 - g, 255 - b
+			}), nil
+		},
+	})
+
+	Register(Operation{
+		Name: "sepia",
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				return 0.393*r + 0.769*g + 0.189*b,
+					0.349*r + 0.686*g + 0.168*b,
+					0.272*r + 0.534*g + 0.131*b
+			}), nil
+		},
+	})
+
+	// amount: -100 makes the image black, 100 white
+	Register(Operation{
+		Name:   "brightness",
+		Params: []Param{{Name: "amount", Required: true, Min: -100, Max: 100}},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			shift := args.Number("amount") / 100 * 255
+
+			return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				return r + shift, g + shift, b + shift
+			}), nil
+		},
+	})
+
+	// amount: -100 makes the image plain gray, 100 doubles the distance of every color to the middle gray
+	Register(Operation{
+		Name:   "contrast",
+		Params: []Param{{Name: "amount", Required: true, Min: -100, Max: 100}},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			factor := 1 + args.Number("amount")/100
+
+			return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				return (r-128)*factor + 128, (g-128)*factor + 128, (b-128)*factor + 128
+			}), nil
+		},
+	})
+}
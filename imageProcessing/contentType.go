@@ -0,0 +1,59 @@
+package imageProcessing
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// UnknownContentType : the content type of files that aren't a known image format
+const UnknownContentType = "application/octet-stream"
+
+// the extension of the stored files of each image content type
+var extensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/bmp":  ".bmp",
+	"image/tiff": ".tiff",
+	"image/webp": ".webp",
+}
+
+// Extension : the file extension of contentType, ".bin" for unknown types
+func Extension(contentType string) string {
+	if extension, exists := extensions[contentType]; exists {
+		return extension
+	}
+
+	return ".bin"
+}
+
+// ContentTypeOf : the content type of a file extension, UnknownContentType for unknown extensions
+func ContentTypeOf(extension string) string {
+	for contentType, known := range extensions {
+		if strings.EqualFold(known, extension) {
+			return contentType
+		}
+	}
+
+	return UnknownContentType
+}
+
+/*
+SniffContentType :
+The image content type of a file from its first bytes, UnknownContentType if it isn't an image.
+http.DetectContentType doesn't know TIFF
+*/
+func SniffContentType(header []byte) string {
+	if bytes.HasPrefix(header, []byte("II*\x00")) || bytes.HasPrefix(header, []byte("MM\x00*")) {
+		return "image/tiff"
+	}
+
+	contentType := http.DetectContentType(header)
+
+	if _, known := extensions[contentType]; known {
+		return contentType
+	}
+
+	return UnknownContentType
+}
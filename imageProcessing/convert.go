@@ -0,0 +1,190 @@
+package imageProcessing
+
+import (
+	"image"
+	"image/color"
+)
+
+// toNRGBA : a copy of img with straight alpha, its bounds moved to the origin
+func toNRGBA(img image.Image) *image.NRGBA {
+	return areaToNRGBA(img, img.Bounds())
+}
+
+// toRGBA : a copy of img with premultiplied alpha, its bounds moved to the origin
+func toRGBA(img image.Image) *image.RGBA {
+	return areaToRGBA(img, img.Bounds())
+}
+
+/*
+areaToNRGBA :
+A copy of the area of img with straight alpha, moved to the origin.
+The usual image types are copied without going through the color.Color interface
+*/
+func areaToNRGBA(img image.Image, area image.Rectangle) *image.NRGBA {
+	canvas := image.NewNRGBA(image.Rect(0, 0, area.Dx(), area.Dy()))
+	width := area.Dx()
+
+	switch src := img.(type) {
+	case *image.NRGBA:
+		parallelRows(area.Dy(), func(minY, maxY int) {
+			for y := minY; y < maxY; y++ {
+				start := src.PixOffset(area.Min.X, area.Min.Y+y)
+				copy(canvas.Pix[y*canvas.Stride:y*canvas.Stride+width*4], src.Pix[start:start+width*4])
+			}
+		})
+	case *image.RGBA:
+		parallelRows(area.Dy(), func(minY, maxY int) {
+			for y := minY; y < maxY; y++ {
+				from := src.Pix[src.PixOffset(area.Min.X, area.Min.Y+y):]
+				to := canvas.Pix[y*canvas.Stride:]
+
+				for x := 0; x < width*4; x += 4 {
+					unpremultiply(to[x:x+4:x+4], from[x:x+4:x+4])
+				}
+			}
+		})
+	case *image.YCbCr:
+		parallelRows(area.Dy(), func(minY, maxY int) {
+			for y := minY; y < maxY; y++ {
+				to := canvas.Pix[y*canvas.Stride:]
+
+				for x := 0; x < width; x++ {
+					yi := src.YOffset(area.Min.X+x, area.Min.Y+y)
+					ci := src.COffset(area.Min.X+x, area.Min.Y+y)
+					to[x*4], to[x*4+1], to[x*4+2] = color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+					to[x*4+3] = 0xff
+				}
+			}
+		})
+	default:
+		// 16 bit images among others, rounded to the nearest 8 bit color
+		parallelRows(area.Dy(), func(minY, maxY int) {
+			for y := minY; y < maxY; y++ {
+				to := canvas.Pix[y*canvas.Stride:]
+
+				for x := 0; x < width; x++ {
+					r, g, b, a := img.At(area.Min.X+x, area.Min.Y+y).RGBA()
+
+					if a != 0 && a != 0xffff {
+						r, g, b = r*0xffff/a, g*0xffff/a, b*0xffff/a
+					}
+
+					to[x*4], to[x*4+1], to[x*4+2], to[x*4+3] = to8(r), to8(g), to8(b), to8(a)
+				}
+			}
+		})
+	}
+
+	return canvas
+}
+
+/*
+areaToRGBA :
+A copy of the area of img with premultiplied alpha, moved to the origin.
+The usual image types are copied without going through the color.Color interface
+*/
+func areaToRGBA(img image.Image, area image.Rectangle) *image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, area.Dx(), area.Dy()))
+	width := area.Dx()
+
+	switch src := img.(type) {
+	case *image.RGBA:
+		parallelRows(area.Dy(), func(minY, maxY int) {
+			for y := minY; y < maxY; y++ {
+				start := src.PixOffset(area.Min.X, area.Min.Y+y)
+				copy(canvas.Pix[y*canvas.Stride:y*canvas.Stride+width*4], src.Pix[start:start+width*4])
+			}
+		})
+	case *image.NRGBA:
+		parallelRows(area.Dy(), func(minY, maxY int) {
+			for y := minY; y < maxY; y++ {
+				from := src.Pix[src.PixOffset(area.Min.X, area.Min.Y+y):]
+				to := canvas.Pix[y*canvas.Stride:]
+
+				for x := 0; x < width*4; x += 4 {
+					premultiply(to[x:x+4:x+4], from[x:x+4:x+4])
+				}
+			}
+		})
+	case *image.YCbCr:
+		// opaque, its straight and premultiplied colors are the same
+		return (*image.RGBA)(areaToNRGBA(src, area))
+	default:
+		// rounding each premultiplied channel keeps the colors under the alpha
+		parallelRows(area.Dy(), func(minY, maxY int) {
+			for y := minY; y < maxY; y++ {
+				to := canvas.Pix[y*canvas.Stride:]
+
+				for x := 0; x < width; x++ {
+					r, g, b, a := img.At(area.Min.X+x, area.Min.Y+y).RGBA()
+					to[x*4], to[x*4+1], to[x*4+2], to[x*4+3] = to8(r), to8(g), to8(b), to8(a)
+				}
+			}
+		})
+	}
+
+	return canvas
+}
+
+// to8 : a 16 bit channel rounded to 8 bits, color.Color models truncate it instead
+func to8(v uint32) uint8 {
+	return uint8((v*0xff + 0x7fff) / 0xffff)
+}
+
+// premultiply : the same rounding as color.RGBAModel
+func premultiply(to, from []uint8) {
+	a := uint32(from[3]) * 0x101
+
+	for c := 0; c < 3; c++ {
+		to[c] = uint8((uint32(from[c]) * 0x101 * a / 0xffff) >> 8)
+	}
+
+	to[3] = from[3]
+}
+
+// unpremultiply : the same rounding as color.NRGBAModel
+func unpremultiply(to, from []uint8) {
+	a := uint32(from[3]) * 0x101
+
+	if a == 0 {
+		to[0], to[1], to[2], to[3] = 0, 0, 0, 0
+		return
+	}
+
+	for c := 0; c < 3; c++ {
+		to[c] = uint8((uint32(from[c]) * 0x101 * 0xffff / a) >> 8)
+	}
+
+	to[3] = from[3]
+}
+
+// clamp : v rounded into a byte
+func clamp(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	default:
+		return uint8(v + 0.5)
+	}
+}
+
+/*
+mapColors :
+Applies f to the straight red, green and blue of every pixel,
+the alpha is kept as is
+*/
+func mapColors(img image.Image, f func(r, g, b float64) (float64, float64, float64)) image.Image {
+	canvas := toNRGBA(img)
+
+	parallelRows(canvas.Rect.Dy(), func(minY, maxY int) {
+		for i := minY * canvas.Stride; i < maxY*canvas.Stride; i += 4 {
+			pixel := canvas.Pix[i : i+3 : i+3]
+			r, g, b := f(float64(pixel[0]), float64(pixel[1]), float64(pixel[2]))
+			pixel[0], pixel[1], pixel[2] = clamp(r), clamp(g), clamp(b)
+		}
+	})
+
+	return canvas
+}
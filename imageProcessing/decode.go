@@ -0,0 +1,78 @@
+package imageProcessing
+
+import (
+	"bytes"
+	"image"
+	"io"
+
+	// decoders registered with image.RegisterFormat, the x/image ones are in decodeExtra.go
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// Decode : decodes an image in any registered format, found from its first bytes
+func Decode(r io.Reader) (image.Image, string, error) {
+	return image.Decode(r)
+}
+
+// Source : the input of a task, decoded and turned upright, with its EXIF metadata if it has any, an Animation for an animated GIF
+type Source struct {
+	Image image.Image
+	Exif  *Exif
+	Info  task.ImageInfo
+}
+
+/*
+Open :
+Decodes an image, every frame of an animated GIF, and turns it as its EXIF orientation tells.
+Invalid EXIF metadata is ignored, as the image itself may still be fine
+*/
+func Open(data []byte) (Source, error) {
+	animation, err := decodeAnimation(data)
+
+	if err != nil {
+		return Source{}, err
+	}
+
+	// GIF images have no EXIF metadata
+	if animation != nil {
+		size := animation.Bounds().Size()
+
+		return Source{Image: animation, Info: task.ImageInfo{
+			Width: size.X, Height: size.Y, Format: "gif", Frames: len(animation.Frames),
+		}}, nil
+	}
+
+	img, format, err := Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return Source{}, err
+	}
+
+	exif, err := ReadExif(data)
+
+	if err != nil {
+		exif = nil
+	}
+
+	source := Source{Image: img, Exif: exif, Info: task.ImageInfo{Format: format}}
+
+	if exif != nil {
+		source.Image = Orient(img, exif.Orientation)
+		source.Info.Orientation = exif.Orientation
+		source.Info.Location = exif.Location
+
+		if exif.Camera != (task.Camera{}) {
+			camera := exif.Camera
+			source.Info.Camera = &camera
+		}
+	}
+
+	size := source.Image.Bounds().Size()
+	source.Info.Width, source.Info.Height = size.X, size.Y
+
+	return source, nil
+}
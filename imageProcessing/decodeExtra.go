@@ -0,0 +1,8 @@
+package imageProcessing
+
+import (
+	// the formats of golang.org/x/image register their decoders when imported
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
@@ -0,0 +1,455 @@
+package imageProcessing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// the tags read from the EXIF metadata
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829a
+	tagFNumber          = 0x829d
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920a
+	tagLensModel        = 0xa434
+	tagGPSLatitude      = 0x0002
+	tagImageWidth       = 0x0100
+	tagImageLength      = 0x0101
+	tagPixelXDimension  = 0xa002
+	tagPixelYDimension  = 0xa003
+	tagStripOffsets     = 0x0111
+	tagStripByteCounts  = 0x0117
+	tagThumbnailOffset  = 0x0201
+	tagThumbnailLength  = 0x0202
+)
+
+// the bytes of each value of the EXIF types, 0 for the unknown ones
+var exifTypeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+var (
+	errInvalidExif = errors.New("invalid EXIF metadata")
+	exifHeader     = []byte("Exif\x00\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+)
+
+/*
+Exif :
+The EXIF metadata of an image, the TIFF structure of its APP1 segment or eXIf chunk.
+Orientation is 1, the image as is, when the metadata doesn't tell
+*/
+type Exif struct {
+	raw         []byte
+	order       binary.ByteOrder
+	Orientation int
+	Location    bool
+	Camera      task.Camera
+	// where the orientation is written in raw, 0 if it isn't
+	orientationAt int
+	// the entries of the width and height of the image, rewritten by Upright
+	widths, heights []exifEntry
+	// where the offset of IFD1, the thumbnail, is written in raw, 0 if it isn't
+	thumbnailLinkAt int
+	// the bytes of the thumbnail in raw
+	thumbnailStart, thumbnailEnd int
+}
+
+/*
+ReadExif :
+The EXIF metadata of a JPEG or PNG image, nil if it has none.
+Only the segments before the image data are read
+*/
+func ReadExif(data []byte) (*Exif, error) {
+	var raw []byte
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		raw = jpegExif(data)
+	case bytes.HasPrefix(data, pngSignature):
+		raw = pngExif(data)
+	}
+
+	if raw == nil {
+		return nil, nil
+	}
+
+	return parseExif(raw)
+}
+
+// jpegExif : the TIFF structure of the EXIF APP1 segment of a JPEG image
+func jpegExif(data []byte) []byte {
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+
+		// the start of scan: the segments are over
+		if marker == 0xda || length < 2 || i+2+length > len(data) {
+			return nil
+		}
+
+		segment := data[i+4 : i+2+length]
+
+		if marker == 0xe1 && bytes.HasPrefix(segment, exifHeader) {
+			return segment[len(exifHeader):]
+		}
+
+		i += 2 + length
+	}
+
+	return nil
+}
+
+// pngExif : the eXIf chunk of a PNG image
+func pngExif(data []byte) []byte {
+	for i := len(pngSignature); i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+
+		if kind == "IDAT" || length < 0 || i+12+length > len(data) {
+			return nil
+		}
+
+		if kind == "eXIf" {
+			return data[i+8 : i+8+length]
+		}
+
+		i += 12 + length
+	}
+
+	return nil
+}
+
+// exifEntry : an entry of an IFD, value being where its values start in the raw metadata
+type exifEntry struct {
+	tag   uint16
+	kind  uint16
+	count int
+	value int
+}
+
+func parseExif(raw []byte) (*Exif, error) {
+	if len(raw) < 8 {
+		return nil, errInvalidExif
+	}
+
+	exif := &Exif{raw: raw, Orientation: 1}
+
+	switch string(raw[:2]) {
+	case "II":
+		exif.order = binary.LittleEndian
+	case "MM":
+		exif.order = binary.BigEndian
+	default:
+		return nil, errInvalidExif
+	}
+
+	ifd0 := exif.order.Uint32(raw[4:])
+	entries, err := exif.ifd(ifd0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		switch entry.tag {
+		case tagMake:
+			exif.Camera.Make = exif.text(entry)
+		case tagModel:
+			exif.Camera.Model = exif.text(entry)
+		case tagImageWidth:
+			exif.widths = exif.appendDimension(exif.widths, entry)
+		case tagImageLength:
+			exif.heights = exif.appendDimension(exif.heights, entry)
+		// a short, as Upright rewrites it in place
+		case tagOrientation:
+			if orientation := int(exif.number(entry)); entry.kind == 3 && orientation >= 1 && orientation <= 8 {
+				exif.Orientation = orientation
+				exif.orientationAt = entry.value
+			}
+		case tagGPSIFD:
+			gps, err := exif.ifd(uint32(exif.number(entry)))
+
+			for _, field := range gps {
+				exif.Location = exif.Location || (err == nil && field.tag == tagGPSLatitude)
+			}
+		// an invalid sub-IFD is skipped, keeping what IFD0 tells
+		case tagExifIFD:
+			fields, _ := exif.ifd(uint32(exif.number(entry)))
+			exif.readCamera(fields)
+		}
+	}
+
+	// IFD1, the thumbnail of the image as uploaded, an invalid one being ignored
+	if exif.thumbnailLinkAt = exif.nextIFDAt(ifd0); exif.thumbnailLinkAt != 0 {
+		thumbnail, _ := exif.ifd(exif.order.Uint32(raw[exif.thumbnailLinkAt:]))
+		exif.readThumbnail(thumbnail)
+	}
+
+	return exif, nil
+}
+
+// appendDimension : entries with entry, when it is a single short or long
+func (exif *Exif) appendDimension(entries []exifEntry, entry exifEntry) []exifEntry {
+	if (entry.kind != 3 && entry.kind != 4) || entry.count != 1 {
+		return entries
+	}
+
+	return append(entries, entry)
+}
+
+// readThumbnail : where the JPEG thumbnail, or the single strip of an uncompressed one, is in raw
+func (exif *Exif) readThumbnail(fields []exifEntry) {
+	var start, length float64
+
+	for _, field := range fields {
+		switch field.tag {
+		case tagThumbnailOffset, tagStripOffsets:
+			// several strips aren't read, the thumbnail is still unlinked from IFD0
+			if field.count != 1 {
+				return
+			}
+
+			start = exif.number(field)
+		case tagThumbnailLength, tagStripByteCounts:
+			length = exif.number(field)
+		}
+	}
+
+	if start < 8 || length < 1 || start+length > float64(len(exif.raw)) {
+		return
+	}
+
+	exif.thumbnailStart, exif.thumbnailEnd = int(start), int(start+length)
+}
+
+func (exif *Exif) readCamera(fields []exifEntry) {
+	for _, field := range fields {
+		switch field.tag {
+		case tagExposureTime:
+			numerator, denominator := exif.rational(field)
+
+			if numerator != 0 && denominator != 0 && numerator < denominator {
+				exif.Camera.Exposure = fmt.Sprintf("1/%g", math.Round(float64(denominator)/float64(numerator)))
+			} else if denominator != 0 {
+				exif.Camera.Exposure = fmt.Sprintf("%g", float64(numerator)/float64(denominator))
+			}
+		case tagFNumber:
+			exif.Camera.FNumber = exif.number(field)
+		case tagISO:
+			exif.Camera.ISO = int(exif.number(field))
+		case tagDateTimeOriginal:
+			exif.Camera.TakenAt = exif.text(field)
+		case tagFocalLength:
+			exif.Camera.FocalLength = exif.number(field)
+		case tagLensModel:
+			exif.Camera.Lens = exif.text(field)
+		case tagPixelXDimension:
+			exif.widths = exif.appendDimension(exif.widths, field)
+		case tagPixelYDimension:
+			exif.heights = exif.appendDimension(exif.heights, field)
+		}
+	}
+}
+
+// ifd : the entries of the IFD at offset whose values are within the metadata
+func (exif *Exif) ifd(offset uint32) ([]exifEntry, error) {
+	start := int(offset)
+
+	if offset > math.MaxInt32 || start+2 > len(exif.raw) {
+		return nil, errInvalidExif
+	}
+
+	count := int(exif.order.Uint16(exif.raw[start:]))
+
+	if start+2+count*12 > len(exif.raw) {
+		return nil, errInvalidExif
+	}
+
+	entries := make([]exifEntry, 0, count)
+
+	for i := 0; i < count; i++ {
+		at := start + 2 + i*12
+		entry := exifEntry{
+			tag:   exif.order.Uint16(exif.raw[at:]),
+			kind:  exif.order.Uint16(exif.raw[at+2:]),
+			count: int(exif.order.Uint32(exif.raw[at+4:])),
+			value: at + 8,
+		}
+
+		// an entry without values has nothing to read
+		if int(entry.kind) >= len(exifTypeSizes) || exifTypeSizes[entry.kind] == 0 || entry.count < 1 || entry.count > len(exif.raw) {
+			continue
+		}
+
+		size := exifTypeSizes[entry.kind] * entry.count
+
+		// values over 4 bytes are written at an offset
+		if size > 4 {
+			entry.value = int(exif.order.Uint32(exif.raw[at+8:]))
+		}
+
+		if entry.value < 0 || entry.value+size > len(exif.raw) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// nextIFDAt : where the offset of the IFD following the one at offset is written, 0 if it isn't in the metadata
+func (exif *Exif) nextIFDAt(offset uint32) int {
+	start := int(offset)
+
+	if offset > math.MaxInt32 || start+2 > len(exif.raw) {
+		return 0
+	}
+
+	at := start + 2 + int(exif.order.Uint16(exif.raw[start:]))*12
+
+	if at+4 > len(exif.raw) {
+		return 0
+	}
+
+	return at
+}
+
+// bytes : the n bytes of the values of entry, nil when they aren't all in the metadata
+func (exif *Exif) bytes(entry exifEntry, n int) []byte {
+	if entry.value < 0 || n < 0 || entry.value+n > len(exif.raw) {
+		return nil
+	}
+
+	return exif.raw[entry.value : entry.value+n]
+}
+
+func (exif *Exif) text(entry exifEntry) string {
+	if entry.kind != 2 {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimRight(string(exif.bytes(entry, entry.count)), "\x00"))
+}
+
+// number : the first value of a short, long or rational entry, 0 when it can't be read
+func (exif *Exif) number(entry exifEntry) float64 {
+	switch entry.kind {
+	case 3:
+		if value := exif.bytes(entry, 2); value != nil {
+			return float64(exif.order.Uint16(value))
+		}
+	case 4:
+		if value := exif.bytes(entry, 4); value != nil {
+			return float64(exif.order.Uint32(value))
+		}
+	case 5:
+		numerator, denominator := exif.rational(entry)
+
+		if denominator == 0 {
+			return 0
+		}
+
+		return float64(numerator) / float64(denominator)
+	}
+
+	return 0
+}
+
+// rational : the numerator and denominator of a rational entry, 0 when it can't be read
+func (exif *Exif) rational(entry exifEntry) (uint32, uint32) {
+	value := exif.bytes(entry, 8)
+
+	if entry.kind != 5 || value == nil {
+		return 0, 0
+	}
+
+	return exif.order.Uint32(value), exif.order.Uint32(value[4:])
+}
+
+/*
+Upright :
+The metadata of an image of size made from the image once turned as its orientation tells,
+with an orientation of 1. The thumbnail of the image as uploaded is dropped, and the width
+and height are those of size
+*/
+func (exif *Exif) Upright(size image.Point) []byte {
+	raw := append([]byte{}, exif.raw...)
+
+	if exif.orientationAt != 0 {
+		exif.order.PutUint16(raw[exif.orientationAt:], 1)
+	}
+
+	if exif.thumbnailLinkAt != 0 {
+		exif.order.PutUint32(raw[exif.thumbnailLinkAt:], 0)
+
+		for i := exif.thumbnailStart; i < exif.thumbnailEnd; i++ {
+			raw[i] = 0
+		}
+	}
+
+	for _, entry := range exif.widths {
+		exif.putDimension(raw, entry, size.X)
+	}
+
+	for _, entry := range exif.heights {
+		exif.putDimension(raw, entry, size.Y)
+	}
+
+	return raw
+}
+
+// putDimension : writes value in raw as the short or long of entry
+func (exif *Exif) putDimension(raw []byte, entry exifEntry, value int) {
+	switch {
+	case entry.kind == 3 && value <= math.MaxUint16:
+		exif.order.PutUint16(raw[entry.value:], uint16(value))
+	case entry.kind == 4:
+		exif.order.PutUint32(raw[entry.value:], uint32(value))
+	}
+}
+
+// embedJPEG : the JPEG image encoded with the metadata raw, in an APP1 segment right after its start
+func embedJPEG(encoded, raw []byte) ([]byte, error) {
+	length := 2 + len(exifHeader) + len(raw)
+
+	if length > math.MaxUint16 {
+		return nil, errors.New("the EXIF metadata is too large for a JPEG image")
+	}
+
+	segment := append([]byte{0xff, 0xe1, byte(length >> 8), byte(length)}, exifHeader...)
+	segment = append(segment, raw...)
+
+	return append(append(append([]byte{}, encoded[:2]...), segment...), encoded[2:]...), nil
+}
+
+// embedPNG : the PNG image encoded with the metadata raw, in an eXIf chunk before its image data
+func embedPNG(encoded, raw []byte) ([]byte, error) {
+	at := bytes.Index(encoded, []byte("IDAT"))
+
+	if at < 4 {
+		return nil, errors.New("no image data in the encoded PNG image")
+	}
+
+	chunk := make([]byte, 8, 12+len(raw))
+	binary.BigEndian.PutUint32(chunk, uint32(len(raw)))
+	copy(chunk[4:], "eXIf")
+	chunk = append(chunk, raw...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// the chunk of the image data starts with its length
+	return append(append(append([]byte{}, encoded[:at-4]...), chunk...), encoded[at-4:]...), nil
+}
@@ -0,0 +1,254 @@
+package imageProcessing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// testEntry : an IFD entry, its values written inline, or at offset when it isn't 0
+type testEntry struct {
+	tag, kind uint16
+	count     uint32
+	value     uint32
+}
+
+// testTIFF : little endian TIFF metadata with an IFD0 of entries at 8, followed by extra
+func testTIFF(entries []testEntry, extra []byte) []byte {
+	raw := []byte("II*\x00\x08\x00\x00\x00")
+	raw = binary.LittleEndian.AppendUint16(raw, uint16(len(entries)))
+
+	for _, entry := range entries {
+		raw = binary.LittleEndian.AppendUint16(raw, entry.tag)
+		raw = binary.LittleEndian.AppendUint16(raw, entry.kind)
+		raw = binary.LittleEndian.AppendUint32(raw, entry.count)
+		raw = binary.LittleEndian.AppendUint32(raw, entry.value)
+	}
+
+	return append(binary.LittleEndian.AppendUint32(raw, 0), extra...)
+}
+
+// testJPEG : a JPEG start and the APP1 segment of raw, enough for ReadExif
+func testJPEG(raw []byte) []byte {
+	length := 2 + len(exifHeader) + len(raw)
+	data := append([]byte{0xff, 0xd8, 0xff, 0xe1, byte(length >> 8), byte(length)}, exifHeader...)
+
+	return append(data, raw...)
+}
+
+func TestReadExif(t *testing.T) {
+	// the 8 bytes of a rational right after an IFD0 of 2 entries: 8 + 2 + 2*12 + 4
+	const after = 38
+
+	tests := []struct {
+		name        string
+		raw         []byte
+		invalid     bool
+		orientation int
+		model       string
+		location    bool
+	}{
+		{
+			name:        "orientation",
+			raw:         testTIFF([]testEntry{{tagOrientation, 3, 1, 6}}, nil),
+			orientation: 6,
+		},
+		{
+			name:        "rational without values as the last entry",
+			raw:         testTIFF([]testEntry{{tagOrientation, 5, 0, 0}}, nil),
+			orientation: 1,
+		},
+		{
+			name:        "rational without values at the end of the metadata",
+			raw:         testTIFF([]testEntry{{tagOrientation, 5, 0, 0}}, nil)[:22],
+			orientation: 1,
+		},
+		{
+			name:        "orientation of another type than short",
+			raw:         testTIFF([]testEntry{{tagOrientation, 4, 1, 6}}, nil),
+			orientation: 1,
+		},
+		{
+			name:        "unknown type",
+			raw:         testTIFF([]testEntry{{tagOrientation, 13, 1, 6}}, nil),
+			orientation: 1,
+		},
+		{
+			name:        "values past the end",
+			raw:         testTIFF([]testEntry{{tagModel, 2, 100, after}, {tagOrientation, 3, 1, 8}}, []byte("short\x00")),
+			orientation: 8,
+		},
+		{
+			name:        "values at a huge offset",
+			raw:         testTIFF([]testEntry{{tagModel, 2, 10, 0xffffffff}}, nil),
+			orientation: 1,
+		},
+		{
+			name:        "count over the metadata",
+			raw:         testTIFF([]testEntry{{tagModel, 5, 0x7fffffff, after}}, nil),
+			orientation: 1,
+		},
+		{
+			name:        "values at an offset",
+			raw:         testTIFF([]testEntry{{tagModel, 2, 6, after}, {tagOrientation, 3, 1, 3}}, []byte("EOS 5D")),
+			orientation: 3,
+			model:       "EOS 5D",
+		},
+		{
+			name:    "IFD past the end",
+			raw:     []byte("II*\x00\xff\x00\x00\x00"),
+			invalid: true,
+		},
+		{
+			name:    "more entries than bytes",
+			raw:     []byte("II*\x00\x08\x00\x00\x00\x09\x00\x12\x01\x03\x00"),
+			invalid: true,
+		},
+		{
+			name:        "Exif IFD past the end",
+			raw:         testTIFF([]testEntry{{tagOrientation, 3, 1, 6}, {tagExifIFD, 4, 1, 0xffff}}, nil),
+			orientation: 6,
+		},
+		{
+			// the GPS IFD right after an IFD0 of 3 entries, at 50, and its rational at 68
+			name: "Exif IFD past the end before a GPS IFD",
+			raw: testTIFF([]testEntry{{tagOrientation, 3, 1, 8}, {tagExifIFD, 4, 1, 0xffff}, {tagGPSIFD, 4, 1, 50}},
+				append(testTIFF([]testEntry{{tagGPSLatitude, 5, 1, 68}}, nil)[8:], make([]byte, 8)...)),
+			orientation: 8,
+			location:    true,
+		},
+		{
+			name:        "Exif IFD of more entries than bytes",
+			raw:         testTIFF([]testEntry{{tagOrientation, 3, 1, 3}, {tagExifIFD, 4, 1, 34}}, []byte("\x09\x00")),
+			orientation: 3,
+		},
+		{
+			name:    "unknown byte order",
+			raw:     []byte("XX*\x00\x08\x00\x00\x00\x00\x00"),
+			invalid: true,
+		},
+		{
+			name:    "shorter than a header",
+			raw:     []byte("II*"),
+			invalid: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exif, err := ReadExif(testJPEG(test.raw))
+
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", exif)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if exif.Orientation != test.orientation || exif.Camera.Model != test.model || exif.Location != test.location {
+				t.Errorf("orientation %d, model %q and location %v, expected %d, %q and %v", exif.Orientation, exif.Camera.Model, exif.Location, test.orientation, test.model, test.location)
+			}
+		})
+	}
+}
+
+// TestReadExifTruncated : every prefix of valid metadata is read without panicking
+func TestReadExifTruncated(t *testing.T) {
+	raw := testTIFF([]testEntry{
+		{tagModel, 2, 6, 62},
+		{tagOrientation, 3, 1, 6},
+		{tagExifIFD, 4, 1, 68},
+		{tagGPSIFD, 4, 1, 86},
+	}, nil)
+	raw = append(raw, "EOS 5D"...)
+	// the Exif IFD, with an exposure of 1/125, and the GPS IFD
+	raw = append(raw, testTIFF([]testEntry{{tagExposureTime, 5, 1, 104}}, nil)[8:]...)
+	raw = append(raw, testTIFF([]testEntry{{tagGPSLatitude, 5, 1, 112}}, nil)[8:]...)
+	// the rationals, at 104 and 112
+	raw = binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(raw, 1), 125)
+	raw = binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(raw, 48), 1)
+
+	exif, err := ReadExif(testJPEG(raw))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exif.Orientation != 6 || exif.Camera.Model != "EOS 5D" || exif.Camera.Exposure != "1/125" || !exif.Location {
+		t.Fatalf("unexpected metadata %+v", exif)
+	}
+
+	if upright, _ := parseExif(exif.Upright(image.Pt(40, 30))); upright.Orientation != 1 {
+		t.Errorf("orientation %d once upright, expected 1", upright.Orientation)
+	}
+
+	for length := range raw {
+		// the error tells nothing more than the metadata being invalid
+		ReadExif(testJPEG(raw[:length]))
+	}
+}
+
+// TestUpright : the thumbnail of the image as uploaded is dropped, and its dimensions are those of the result
+func TestUpright(t *testing.T) {
+	// IFD0 of 5 entries at 8, the Exif IFD at 74, IFD1 at 104 and its thumbnail at 134
+	thumbnail := []byte("\xff\xd8thumbnail\xff\xd9")
+	raw := testTIFF([]testEntry{
+		{tagImageWidth, 3, 1, 3000},
+		{tagImageLength, 4, 1, 4000},
+		{tagOrientation, 3, 1, 6},
+		{tagExifIFD, 4, 1, 74},
+		{tagModel, 2, 4, 0x00534f45},
+	}, nil)
+	binary.LittleEndian.PutUint32(raw[70:], 104)
+	raw = append(raw, testTIFF([]testEntry{{tagPixelXDimension, 4, 1, 3000}, {tagPixelYDimension, 3, 1, 4000}}, nil)[8:]...)
+	raw = append(raw, testTIFF([]testEntry{{tagThumbnailOffset, 4, 1, 134}, {tagThumbnailLength, 4, 1, uint32(len(thumbnail))}}, nil)[8:]...)
+	raw = append(raw, thumbnail...)
+
+	exif, err := parseExif(raw)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exif.thumbnailStart != 134 || exif.thumbnailEnd != len(raw) || len(exif.widths) != 2 || len(exif.heights) != 2 {
+		t.Fatalf("thumbnail at %d-%d, %d widths and %d heights read", exif.thumbnailStart, exif.thumbnailEnd, len(exif.widths), len(exif.heights))
+	}
+
+	upright := exif.Upright(image.Pt(40, 30))
+
+	if bytes.Contains(upright, thumbnail) || binary.LittleEndian.Uint32(upright[70:]) != 0 {
+		t.Error("the thumbnail is still in the metadata")
+	}
+
+	if !bytes.Contains(raw, thumbnail) {
+		t.Error("the metadata read was changed")
+	}
+
+	read, err := parseExif(upright)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.Orientation != 1 || read.Camera.Model != "EOS" || read.thumbnailEnd != 0 {
+		t.Errorf("unexpected metadata %+v", read)
+	}
+
+	for _, entry := range read.widths {
+		if width := read.number(entry); width != 40 {
+			t.Errorf("width of %g, expected 40", width)
+		}
+	}
+
+	for _, entry := range read.heights {
+		if height := read.number(entry); height != 30 {
+			t.Errorf("height of %g, expected 30", height)
+		}
+	}
+}
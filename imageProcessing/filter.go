@@ -0,0 +1,132 @@
+package imageProcessing
+
+import (
+	"image"
+	"math"
+)
+
+func init() {
+	// radius: the standard deviation of the gaussian, in pixels
+	Register(Operation{
+		Name:   "blur",
+		Params: []Param{{Name: "radius", Default: 2.0, Min: 0.1, Max: 100}},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			return gaussianBlur(toRGBA(img), args.Number("radius")), nil
+		},
+	})
+
+	// unsharp mask: adds amount times the difference between the image and its blurred copy
+	Register(Operation{
+		Name: "sharpen",
+		Params: []Param{
+			{Name: "amount", Default: 1.0, Min: 0, Max: 10},
+			{Name: "radius", Default: 1.0, Min: 0.1, Max: 100},
+		},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			return sharpen(toRGBA(img), args.Number("amount"), args.Number("radius")), nil
+		},
+	})
+}
+
+// gaussianKernel : the weights of a gaussian of standard deviation sigma over 3 sigmas, summing to 1
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(sigma * 3))
+	weights := make([]float64, 2*radius+1)
+	sum := 0.0
+
+	for i := range weights {
+		d := float64(i - radius)
+		weights[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += weights[i]
+	}
+
+	for i := range weights {
+		weights[i] /= sum
+	}
+
+	return weights
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+
+	if v > max {
+		return max
+	}
+
+	return v
+}
+
+/*
+gaussianBlur :
+Blurs the rows then the columns, the edge pixels are repeated beyond the borders.
+The colors are premultiplied so that transparent pixels don't bleed into the others
+*/
+func gaussianBlur(src *image.RGBA, sigma float64) *image.RGBA {
+	weights := gaussianKernel(sigma)
+	radius := len(weights) / 2
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	rows := make([]float64, width*height*4)
+
+	parallelRows(height, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := 0; x < width; x++ {
+				for c := 0; c < 4; c++ {
+					sum := 0.0
+
+					for i, weight := range weights {
+						sx := clampInt(x+i-radius, 0, width-1)
+						sum += weight * float64(src.Pix[y*src.Stride+sx*4+c])
+					}
+
+					rows[(y*width+x)*4+c] = sum
+				}
+			}
+		}
+	})
+
+	dst := image.NewRGBA(src.Rect)
+
+	// every row of the first pass is written before the columns are read
+	parallelRows(height, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := 0; x < width; x++ {
+				for c := 0; c < 4; c++ {
+					sum := 0.0
+
+					for i, weight := range weights {
+						sy := clampInt(y+i-radius, 0, height-1)
+						sum += weight * rows[(sy*width+x)*4+c]
+					}
+
+					dst.Pix[y*dst.Stride+x*4+c] = clamp(sum)
+				}
+			}
+		}
+	})
+
+	return dst
+}
+
+func sharpen(src *image.RGBA, amount, radius float64) *image.RGBA {
+	blurred := gaussianBlur(src, radius)
+	dst := image.NewRGBA(src.Rect)
+
+	parallelRows(src.Rect.Dy(), func(minY, maxY int) {
+		for i := minY * src.Stride; i < maxY*src.Stride; i += 4 {
+			alpha := src.Pix[i+3]
+
+			for c := 0; c < 3; c++ {
+				v := float64(src.Pix[i+c]) + amount*(float64(src.Pix[i+c])-float64(blurred.Pix[i+c]))
+				// a premultiplied color can't exceed its alpha
+				dst.Pix[i+c] = clamp(math.Min(v, float64(alpha)))
+			}
+
+			dst.Pix[i+3] = alpha
+		}
+	})
+
+	return dst
+}
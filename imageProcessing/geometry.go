@@ -0,0 +1,207 @@
+package imageProcessing
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// the largest width or height an operation may produce
+const maxSide = 20000
+
+func init() {
+	/*
+		exact stretches the image to the width and height, fit keeps its aspect ratio within them,
+		fill keeps it too and crops the center of the image to cover them.
+		With only the width or the height, the other one keeps the aspect ratio whatever the mode
+	*/
+	Register(Operation{
+		Name: "resize",
+		Params: []Param{
+			{Name: "width", Default: 0.0, Min: 0, Max: maxSide},
+			{Name: "height", Default: 0.0, Min: 0, Max: maxSide},
+			{Name: "mode", Default: "exact", Choices: []string{"exact", "fit", "fill"}},
+			{Name: "kernel", Default: DefaultKernel, Choices: KernelNames()},
+		},
+		Check: func(args Args) error {
+			if args.Int("width") == 0 && args.Int("height") == 0 {
+				return errors.New("needs a width, a height, or both")
+			}
+
+			// the size of the others depends on the image
+			if args.Int("width") != 0 && args.Int("height") != 0 && args.String("mode") != "fit" {
+				return ResultLimits.CheckSize(args.Int("width"), args.Int("height"))
+			}
+
+			return nil
+		},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			bounds := img.Bounds()
+			area, width, height := resizeArea(bounds.Dx(), bounds.Dy(), args.Int("width"), args.Int("height"), args.String("mode"))
+
+			if err := ResultLimits.CheckSize(width, height); err != nil {
+				return nil, err
+			}
+
+			return resample(areaToRGBA(img, area.Add(bounds.Min)), width, height, kernels[args.String("kernel")]), nil
+		},
+	})
+
+	// x and y: the top left corner of the area kept, from the top left corner of the image
+	Register(Operation{
+		Name: "crop",
+		Params: []Param{
+			{Name: "x", Default: 0.0, Min: 0, Max: maxSide},
+			{Name: "y", Default: 0.0, Min: 0, Max: maxSide},
+			{Name: "width", Required: true, Min: 1, Max: maxSide},
+			{Name: "height", Required: true, Min: 1, Max: maxSide},
+		},
+		Check: func(args Args) error {
+			return ResultLimits.CheckSize(args.Int("width"), args.Int("height"))
+		},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			bounds := img.Bounds()
+			area := image.Rect(args.Int("x"), args.Int("y"), args.Int("x")+args.Int("width"), args.Int("y")+args.Int("height"))
+
+			if !area.In(image.Rect(0, 0, bounds.Dx(), bounds.Dy())) {
+				return nil, fmt.Errorf("the area %v is outside of the %dx%d image", area, bounds.Dx(), bounds.Dy())
+			}
+
+			return areaToNRGBA(img, area.Add(bounds.Min)), nil
+		},
+	})
+
+	// angle: clockwise, in degrees
+	Register(Operation{
+		Name:   "rotate",
+		Params: []Param{{Name: "angle", Required: true, Min: -360, Max: 360}},
+		Check: func(args Args) error {
+			if math.Mod(args.Number("angle"), 90) != 0 {
+				return errors.New("angle must be a multiple of 90")
+			}
+
+			return nil
+		},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			quarters := (args.Int("angle")/90%4 + 4) % 4
+			rotated := toNRGBA(img)
+
+			for i := 0; i < quarters; i++ {
+				rotated = rotateClockwise(rotated)
+			}
+
+			return rotated, nil
+		},
+	})
+
+	Register(Operation{
+		Name:   "flip",
+		Params: []Param{{Name: "direction", Default: "horizontal", Choices: []string{"horizontal", "vertical"}}},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			return flip(toNRGBA(img), args.String("direction") == "horizontal"), nil
+		},
+	})
+}
+
+/*
+resizeArea :
+The area of a srcWidth x srcHeight image to resize, and the size to resize it to,
+for a width and height of which one may be 0
+*/
+func resizeArea(srcWidth, srcHeight, width, height int, mode string) (image.Rectangle, int, int) {
+	area := image.Rect(0, 0, srcWidth, srcHeight)
+	ratio := float64(srcWidth) / float64(srcHeight)
+	side := func(v float64) int {
+		return clampInt(int(math.Round(v)), 1, maxSide)
+	}
+
+	switch {
+	case width == 0:
+		return area, side(float64(height) * ratio), height
+	case height == 0:
+		return area, width, side(float64(width) / ratio)
+	case mode == "fit" && ratio > float64(width)/float64(height):
+		return area, width, side(float64(width) / ratio)
+	case mode == "fit":
+		return area, side(float64(height) * ratio), height
+	case mode == "fill" && ratio > float64(width)/float64(height):
+		// too wide: the left and right sides are cropped
+		kept := side(float64(srcHeight*width) / float64(height))
+		return image.Rect((srcWidth-kept)/2, 0, (srcWidth-kept)/2+kept, srcHeight), width, height
+	case mode == "fill":
+		kept := side(float64(srcWidth*height) / float64(width))
+		return image.Rect(0, (srcHeight-kept)/2, srcWidth, (srcHeight-kept)/2+kept), width, height
+	}
+
+	return area, width, height
+}
+
+func rotateClockwise(src *image.NRGBA) *image.NRGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, height, width))
+
+	parallelRows(width, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := 0; x < height; x++ {
+				// the left column of the source becomes the top row
+				copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[(height-1-x)*src.Stride+y*4:])
+			}
+		}
+	})
+
+	return dst
+}
+
+func flip(src *image.NRGBA, horizontal bool) *image.NRGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewNRGBA(src.Rect)
+
+	parallelRows(height, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := 0; x < width; x++ {
+				sx, sy := x, y
+
+				if horizontal {
+					sx = width - 1 - x
+				} else {
+					sy = height - 1 - y
+				}
+
+				copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+			}
+		}
+	})
+
+	return dst
+}
+
+/*
+Orient :
+The image turned as the EXIF orientation tells, so that it is displayed upright.
+Orientation 1, or an unknown one, leaves it as is
+*/
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	oriented := toNRGBA(img)
+
+	switch orientation {
+	case 2:
+		return flip(oriented, true)
+	case 3:
+		return rotateClockwise(rotateClockwise(oriented))
+	case 4:
+		return flip(oriented, false)
+	case 5:
+		return flip(rotateClockwise(oriented), true)
+	case 6:
+		return rotateClockwise(oriented)
+	case 7:
+		return flip(rotateClockwise(rotateClockwise(rotateClockwise(oriented))), true)
+	}
+
+	return rotateClockwise(rotateClockwise(rotateClockwise(oriented)))
+}
@@ -0,0 +1,196 @@
+package imageProcessing
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// go test ./imageProcessing -run TestGolden -update, after changing an operation on purpose
+var update = flag.Bool("update", false, "write the golden images of TestGolden instead of comparing with them")
+
+// the parameters of the operations in their golden images, the others run without any
+var goldenParams = map[string]map[string]interface{}{
+	"brightness": {"amount": 40.0},
+	"contrast":   {"amount": 50.0},
+	"blur":       {"radius": 1.5},
+	"resize":     {"width": 40.0, "height": 20.0, "mode": "fill", "kernel": "lanczos"},
+	"crop":       {"x": 5.0, "y": 4.0, "width": 30.0, "height": 20.0},
+	"rotate":     {"angle": 90.0},
+	"flip":       {"direction": "vertical"},
+	"watermark":  {"overlay": "logo", "anchor": "center", "opacity": 0.7, "scale": 1.5},
+	"text":       {"text": "Golden\nimage", "size": 12.0, "color": "#ffcc0080"},
+}
+
+// goldenOverlays : the only overlay image of the operations, translucent too
+func goldenOverlays(name string) (image.Image, error) {
+	if name != "logo" {
+		return nil, errors.New("no overlay " + name)
+	}
+
+	return gradientPattern(image.NewNRGBA(image.Rect(0, 0, 24, 16))), nil
+}
+
+/*
+TestGolden :
+Runs every registered operation on images with translucent pixels and bounds away from
+the origin, in 8 and 16 bits, on one goroutine and on several, and compares the results
+with the golden images in testdata/golden
+*/
+func TestGolden(t *testing.T) {
+	defer SetParallelism(parallelism)
+
+	inputs := []struct {
+		name string
+		img  image.Image
+	}{
+		{"8bit", gradientPattern(image.NewNRGBA(image.Rect(7, 3, 71, 51)))},
+		{"16bit", gradientPattern(image.NewNRGBA64(image.Rect(-5, 9, 59, 57)))},
+	}
+
+	for _, name := range Names() {
+		steps := []task.Operation{{Name: name, Params: goldenParams[name]}}
+
+		for _, input := range inputs {
+			t.Run(name+"-"+input.name, func(t *testing.T) {
+				path := filepath.Join("testdata", "golden", name+"-"+input.name+".png")
+
+				SetParallelism(1)
+				single, err := RunWith(input.img, steps, goldenOverlays)
+
+				if err != nil {
+					t.Fatalf("needs parameters in goldenParams: %s", err.Error())
+				}
+
+				SetParallelism(3)
+				parallel, err := RunWith(input.img, steps, goldenOverlays)
+
+				if err != nil || !sameImage(single, parallel) {
+					t.Errorf("differs on several goroutines: %v", err)
+				}
+
+				if *update {
+					if err = writePNG(path, single); err != nil {
+						t.Fatal(err)
+					}
+
+					return
+				}
+
+				golden, err := readPNG(path)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// encoding premultiplied colors as PNG rounds them
+				if encoded, err := roundTrip(single); err != nil || !sameImage(encoded, golden) {
+					t.Errorf("differs from %s", path)
+				}
+			})
+		}
+	}
+}
+
+/*
+gradientPattern :
+Fills img with gradients, a translucent band and a transparent corner,
+which catch mistakes with premultiplied alpha
+*/
+func gradientPattern(img image.Image) image.Image {
+	canvas := img.(interface {
+		Set(x, y int, c color.Color)
+	})
+	bounds := img.Bounds()
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			c := color.NRGBA64{
+				R: uint16(x * 0xffff / bounds.Dx()),
+				G: uint16(y * 0xffff / bounds.Dy()),
+				B: uint16((x*y*0x101 + 0x55) % 0xffff),
+				A: 0xffff,
+			}
+
+			switch {
+			case x < 10 && y < 10:
+				c.A = 0
+			case y > bounds.Dy()*2/3:
+				c.A = uint16(0x3fff + x*0x101)
+			}
+
+			canvas.Set(bounds.Min.X+x, bounds.Min.Y+y, c)
+		}
+	}
+
+	return img
+}
+
+// sameImage : whether both images have the same size and colors, whatever their types
+func sameImage(a, b image.Image) bool {
+	boundsA, boundsB := a.Bounds(), b.Bounds()
+
+	if boundsA.Size() != boundsB.Size() {
+		return false
+	}
+
+	for y := 0; y < boundsA.Dy(); y++ {
+		for x := 0; x < boundsA.Dx(); x++ {
+			r1, g1, b1, a1 := a.At(boundsA.Min.X+x, boundsA.Min.Y+y).RGBA()
+			r2, g2, b2, a2 := b.At(boundsB.Min.X+x, boundsB.Min.Y+y).RGBA()
+
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// roundTrip : img as it is read back once written as PNG
+func roundTrip(img image.Image) (image.Image, error) {
+	buffer := bytes.Buffer{}
+
+	if err := png.Encode(&buffer, img); err != nil {
+		return nil, err
+	}
+
+	return png.Decode(&buffer)
+}
+
+func readPNG(path string) (image.Image, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return png.Decode(file)
+}
+
+func writePNG(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return png.Encode(file, img)
+}
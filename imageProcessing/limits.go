@@ -0,0 +1,189 @@
+package imageProcessing
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Limits : the largest images accepted, 0 meaning no limit
+type Limits struct {
+	MaxBytes  int64
+	MaxWidth  int
+	MaxHeight int
+	// decoding allocates about 4 bytes per pixel, whatever the size of the file
+	MaxPixels int64
+}
+
+// ResultLimits : the largest images an operation, built in or plugin, may produce
+var ResultLimits = Limits{MaxWidth: maxSide, MaxHeight: maxSide, MaxPixels: 100000000}
+
+// LimitError : an image over one of the Limits
+type LimitError struct {
+	reason string
+}
+
+func (err LimitError) Error() string {
+	return err.reason
+}
+
+// ErrUnknownFormat : the data isn't an image in a format with a registered decoder
+var ErrUnknownFormat = errors.New("not an image in a supported format (png, jpeg, gif, bmp, tiff, webp)")
+
+/*
+Check :
+Checks that r is an image of size bytes within the limits, without decoding more than its header.
+Returns its content type, the error is a LimitError when it is too large
+*/
+func (limits Limits) Check(r io.Reader, size int64) (string, error) {
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		return "", LimitError{fmt.Sprintf("the image is %d bytes, over the limit of %d bytes", size, limits.MaxBytes)}
+	}
+
+	buffered := bufio.NewReaderSize(r, 512)
+	header, err := buffered.Peek(512)
+
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	contentType := SniffContentType(header)
+
+	if contentType == UnknownContentType {
+		return "", ErrUnknownFormat
+	}
+
+	// what DecodeConfig reads, to count the frames of a GIF image from its start
+	consumed := &bytes.Buffer{}
+	config, _, err := image.DecodeConfig(io.TeeReader(buffered, consumed))
+
+	if err != nil {
+		return "", fmt.Errorf("the %s image can't be read: %s", contentType, err.Error())
+	}
+
+	if err = limits.CheckSize(config.Width, config.Height); err != nil {
+		return "", err
+	}
+
+	// the worker decodes every frame of an animated GIF whole
+	if contentType == "image/gif" && limits.MaxPixels > 0 {
+		frames, err := countFrames(io.MultiReader(consumed, buffered))
+
+		if err != nil {
+			return "", fmt.Errorf("the %s image can't be read: %s", contentType, err.Error())
+		}
+
+		if pixels := int64(config.Width) * int64(config.Height) * int64(frames); pixels > limits.MaxPixels {
+			return "", LimitError{fmt.Sprintf("the image has %d frames of %dx%d pixels, over the limit of %d pixels",
+				frames, config.Width, config.Height, limits.MaxPixels)}
+		}
+	}
+
+	return contentType, nil
+}
+
+// CheckSize : checks that a width x height image is within the limits, before allocating it, the error being a LimitError
+func (limits Limits) CheckSize(width, height int) error {
+	if (limits.MaxWidth > 0 && width > limits.MaxWidth) || (limits.MaxHeight > 0 && height > limits.MaxHeight) {
+		return LimitError{fmt.Sprintf("the image is %dx%d pixels, over the limit of %dx%d",
+			width, height, limits.MaxWidth, limits.MaxHeight)}
+	}
+
+	if pixels := int64(width) * int64(height); limits.MaxPixels > 0 && pixels > limits.MaxPixels {
+		return LimitError{fmt.Sprintf("the image has %d pixels, over the limit of %d", pixels, limits.MaxPixels)}
+	}
+
+	return nil
+}
+
+/*
+countFrames :
+The frames of a GIF image, found from its blocks without decoding them.
+The GIF format is described in https://www.w3.org/Graphics/GIF/spec-gif89a.txt
+*/
+func countFrames(r io.Reader) (int, error) {
+	buffered := bufio.NewReader(r)
+	header := make([]byte, 13)
+
+	if _, err := io.ReadFull(buffered, header); err != nil {
+		return 0, err
+	}
+
+	// the global color table
+	if err := skipColorTable(buffered, header[10]); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+
+	for {
+		introducer, err := buffered.ReadByte()
+
+		if err != nil {
+			return 0, err
+		}
+
+		switch introducer {
+		// an extension: its label, then its data sub-blocks
+		case 0x21:
+			if _, err = buffered.ReadByte(); err == nil {
+				err = skipSubBlocks(buffered)
+			}
+		// an image descriptor, its local color table, the LZW code size and the data sub-blocks
+		case 0x2c:
+			descriptor := make([]byte, 9)
+
+			if _, err = io.ReadFull(buffered, descriptor); err == nil {
+				err = skipColorTable(buffered, descriptor[8])
+			}
+
+			if err == nil {
+				_, err = buffered.ReadByte()
+			}
+
+			if err == nil {
+				err = skipSubBlocks(buffered)
+			}
+
+			frames++
+		// the trailer
+		case 0x3b:
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("unknown block 0x%02x", introducer)
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// skipColorTable : skips the color table that the packed fields of a descriptor tell about
+func skipColorTable(r *bufio.Reader, fields byte) error {
+	if fields&0x80 == 0 {
+		return nil
+	}
+
+	_, err := r.Discard(3 << (fields&0x07 + 1))
+
+	return err
+}
+
+// skipSubBlocks : skips data sub-blocks, each one starting with its size, up to the empty one
+func skipSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+
+		if err != nil || size == 0 {
+			return err
+		}
+
+		if _, err = r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
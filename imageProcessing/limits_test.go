@@ -0,0 +1,129 @@
+package imageProcessing
+
+import (
+	"image"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+func TestResultLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		width   int
+		height  int
+		step    task.Operation
+		invalid bool
+		over    bool
+	}{
+		{
+			name:  "resize within the limits",
+			width: 40, height: 30,
+			step: task.Operation{Name: "resize", Params: map[string]interface{}{"width": 10000.0, "height": 10000.0}},
+		},
+		{
+			name:  "resize of both sides over the pixels",
+			width: 40, height: 30,
+			step:    task.Operation{Name: "resize", Params: map[string]interface{}{"width": 20000.0, "height": 20000.0}},
+			invalid: true,
+		},
+		{
+			name:  "filling both sides over the pixels",
+			width: 40, height: 30,
+			step:    task.Operation{Name: "resize", Params: map[string]interface{}{"width": 20000.0, "height": 20000.0, "mode": "fill"}},
+			invalid: true,
+		},
+		{
+			name:  "fitting within both sides over the pixels",
+			width: 1, height: 100,
+			step: task.Operation{Name: "resize", Params: map[string]interface{}{"width": 20000.0, "height": 20000.0, "mode": "fit"}},
+			// 200x20000
+		},
+		{
+			name:  "resize of the width of a tall image",
+			width: 1, height: 100,
+			step: task.Operation{Name: "resize", Params: map[string]interface{}{"width": 20000.0}},
+			// 20000 by 2000000, kept to 20000
+			over: true,
+		},
+		{
+			name:  "resize of the height of a wide image",
+			width: 2, height: 1,
+			step: task.Operation{Name: "resize", Params: map[string]interface{}{"height": 20000.0}},
+			// 40000 kept to 20000, by 20000
+			over: true,
+		},
+		{
+			name:  "crop over the pixels",
+			width: 40, height: 30,
+			step:    task.Operation{Name: "crop", Params: map[string]interface{}{"width": 20000.0, "height": 20000.0}},
+			invalid: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate([]task.Operation{test.step})
+
+			if test.invalid {
+				if err == nil {
+					t.Fatal("expected the operation to be invalid")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.over {
+				return
+			}
+
+			_, err = Run(image.NewNRGBA(image.Rect(0, 0, test.width, test.height)), []task.Operation{test.step})
+
+			if err == nil {
+				t.Fatal("expected an image over the limits")
+			}
+		})
+	}
+}
+
+func TestResultLimitsOfAnimation(t *testing.T) {
+	frame := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	animation := &Animation{Frames: []image.Image{frame, frame, frame}, Delays: []int{1, 1, 1}, Disposals: []byte{0, 0, 0}}
+
+	// each frame within the limits, not the 3 of them
+	_, err := Run(animation, []task.Operation{{Name: "resize", Params: map[string]interface{}{"width": 6000.0, "height": 6000.0}}})
+
+	if _, over := err.(LimitError); !over {
+		t.Fatalf("expected a LimitError, got %v", err)
+	}
+
+	resized, err := Run(animation, []task.Operation{{Name: "resize", Params: map[string]interface{}{"width": 8.0}}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frames := resized.(*Animation).Frames; len(frames) != 3 || frames[2].Bounds().Dx() != 8 {
+		t.Errorf("unexpected frames %v", frames)
+	}
+}
+
+func TestMaxOperations(t *testing.T) {
+	steps := make([]task.Operation, maxOperations+1)
+
+	for i := range steps {
+		steps[i] = task.Operation{Name: "blur", Params: map[string]interface{}{"radius": 50.0}}
+	}
+
+	if err := ValidateSpec(task.Spec{Operations: steps[:maxOperations]}); err != nil {
+		t.Fatalf("%d operations refused: %s", maxOperations, err.Error())
+	}
+
+	if err := ValidateSpec(task.Spec{Operations: steps}); err == nil {
+		t.Fatalf("%d operations accepted", len(steps))
+	}
+}
@@ -0,0 +1,192 @@
+package imageProcessing
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// DefaultFormat : the format of the results of tasks that don't choose one, but for animated GIFs
+const DefaultFormat = "png"
+
+/*
+Format :
+An output format, Lossy formats take a quality, Animated ones encode every frame of an Animation.
+Embed adds EXIF metadata to an encoded image, nil for the formats that can't carry it
+*/
+type Format struct {
+	Name        string
+	ContentType string
+	Lossy       bool
+	Animated    bool
+	Encode      func(w io.Writer, img image.Image, quality int) error
+	Embed       func(encoded, exif []byte) ([]byte, error)
+}
+
+var formats = map[string]Format{
+	"png": {
+		Name:        "png",
+		ContentType: "image/png",
+		Encode: func(w io.Writer, img image.Image, quality int) error {
+			return png.Encode(w, Still(img))
+		},
+		Embed: embedPNG,
+	},
+	"jpeg": {
+		Name:        "jpeg",
+		ContentType: "image/jpeg",
+		Lossy:       true,
+		Encode: func(w io.Writer, img image.Image, quality int) error {
+			if quality == 0 {
+				quality = jpeg.DefaultQuality
+			}
+
+			return jpeg.Encode(w, Still(img), &jpeg.Options{Quality: quality})
+		},
+		Embed: embedJPEG,
+	},
+	// 256 colors of the Plan 9 palette, with dithering, every frame of an Animation
+	"gif": {
+		Name:        "gif",
+		ContentType: "image/gif",
+		Animated:    true,
+		Encode: func(w io.Writer, img image.Image, quality int) error {
+			if animation, animated := img.(*Animation); animated {
+				return encodeAnimation(w, animation)
+			}
+
+			return gif.Encode(w, img, nil)
+		},
+	},
+}
+
+// FormatOf : the format of output, the default one if it doesn't choose any
+func FormatOf(output task.Output) (Format, error) {
+	name := output.Format
+
+	if len(name) == 0 {
+		name = DefaultFormat
+	}
+
+	format, exists := formats[name]
+
+	if !exists {
+		names := []string{}
+
+		for name := range formats {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		return Format{}, fmt.Errorf("unknown output format %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+
+	return format, nil
+}
+
+// OutputOf : the output of a task for its input img, an animated GIF staying one when the task chooses no format
+func OutputOf(output task.Output, img image.Image) task.Output {
+	if _, animated := img.(*Animation); animated && len(output.Format) == 0 {
+		output.Format = "gif"
+	}
+
+	return output
+}
+
+// ValidateOutput : checks the format of output, and that its quality and metadata fit it
+func ValidateOutput(output task.Output) error {
+	format, err := FormatOf(output)
+
+	if err != nil {
+		return err
+	}
+
+	if output.Quality != 0 && !format.Lossy {
+		return fmt.Errorf("the %s output format has no quality", format.Name)
+	}
+
+	if output.Quality < 0 || output.Quality > 100 {
+		return fmt.Errorf("the output quality must be between 1 and 100")
+	}
+
+	switch output.Metadata {
+	case "", task.MetadataStrip:
+	case task.MetadataPreserve:
+		if format.Embed == nil {
+			return fmt.Errorf("the %s output format can't carry metadata", format.Name)
+		}
+	default:
+		return fmt.Errorf("unknown metadata option %q, expected %s or %s", output.Metadata, task.MetadataStrip, task.MetadataPreserve)
+	}
+
+	return nil
+}
+
+// the most thumbnails a task may make
+const maxThumbnails = 16
+
+// ValidateSpec : checks the type, operations, thumbnails and output of spec, before creating a task with them
+func ValidateSpec(spec task.Spec) error {
+	if err := Validate(spec.Operations); err != nil {
+		return err
+	}
+
+	if err := validateThumbnails(spec); err != nil {
+		return err
+	}
+
+	return ValidateOutput(spec.Output)
+}
+
+// validateThumbnails : checks that only thumbnails tasks have thumbnails, and that they have valid sizes and unique names
+func validateThumbnails(spec task.Spec) error {
+	switch spec.Type {
+	case task.TypeImage:
+		if len(spec.Thumbnails) != 0 {
+			return fmt.Errorf("only the %s tasks have thumbnails", task.TypeThumbnails)
+		}
+
+		return nil
+	case task.TypeThumbnails:
+	default:
+		return fmt.Errorf("unknown task type %q, expected %s or none", spec.Type, task.TypeThumbnails)
+	}
+
+	if len(spec.Thumbnails) > maxThumbnails {
+		return fmt.Errorf("%d thumbnails, a task makes at most %d", len(spec.Thumbnails), maxThumbnails)
+	}
+
+	names := make(map[string]bool)
+
+	for i, thumbnail := range spec.Thumbnails {
+		name := thumbnail.Name()
+
+		if err := task.ValidateVariant(name); err != nil {
+			return fmt.Errorf("thumbnail %d: %s", i, err.Error())
+		}
+
+		if name == task.VariantOriginal || name == task.VariantResult {
+			return fmt.Errorf("thumbnail %d: %s is the name of another image of the task", i, name)
+		}
+
+		if names[name] {
+			return fmt.Errorf("thumbnail %d: another thumbnail is named %s", i, name)
+		}
+
+		names[name] = true
+
+		if _, err := prepare([]task.Operation{thumbnail.Resize()}); err != nil {
+			return fmt.Errorf("thumbnail %d: %s", i, strings.TrimPrefix(err.Error(), "operation 0: "))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package imageProcessing
+
+import (
+	"image"
+	"math"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// the corners, sides and center of an image an overlay is placed against
+var anchors = []string{"topLeft", "top", "topRight", "left", "center", "right", "bottomLeft", "bottom", "bottomRight"}
+
+func init() {
+	// overlay: the name of an overlay image of the tenant, margin: in pixels from the sides it is anchored to
+	Register(Operation{
+		Name: "watermark",
+		Params: []Param{
+			{Name: "overlay", Required: true, Text: true, Min: 1, Max: 32},
+			{Name: "anchor", Default: "bottomRight", Choices: anchors},
+			{Name: "opacity", Default: 1.0, Min: 0, Max: 1},
+			{Name: "scale", Default: 1.0, Min: 0.01, Max: 10},
+			{Name: "margin", Default: 0.0, Min: 0, Max: maxSide},
+		},
+		Overlay: "overlay",
+		Check: func(args Args) error {
+			return task.ValidateOverlay(args.String("overlay"))
+		},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			overlay := toRGBA(args.Image("overlay"))
+			scale := args.Number("scale")
+			size := image.Point{
+				X: clampInt(int(math.Round(float64(overlay.Rect.Dx())*scale)), 1, maxSide),
+				Y: clampInt(int(math.Round(float64(overlay.Rect.Dy())*scale)), 1, maxSide),
+			}
+
+			canvas := toRGBA(img)
+			at := anchorPoint(args.String("anchor"), canvas.Rect.Size(), size, args.Int("margin"))
+
+			// only the part on the image is resized, at most as large as the image
+			if size != overlay.Rect.Size() {
+				overlay = resampleArea(overlay, size.X, size.Y, visibleArea(canvas.Rect, size, at), kernels["lanczos"])
+			}
+
+			stamp(canvas, overlay, at, args.Number("opacity"))
+
+			return canvas, nil
+		},
+	})
+}
+
+// anchorPoint : where the top left corner of an overlay of size goes on a canvas of size canvas
+func anchorPoint(anchor string, canvas, size image.Point, margin int) image.Point {
+	at := image.Point{X: (canvas.X - size.X) / 2, Y: (canvas.Y - size.Y) / 2}
+
+	switch anchor {
+	case "topLeft", "left", "bottomLeft":
+		at.X = margin
+	case "topRight", "right", "bottomRight":
+		at.X = canvas.X - size.X - margin
+	}
+
+	switch anchor {
+	case "topLeft", "top", "topRight":
+		at.Y = margin
+	case "bottomLeft", "bottom", "bottomRight":
+		at.Y = canvas.Y - size.Y - margin
+	}
+
+	return at
+}
+
+// visibleArea : the part of an overlay of size, its top left corner at at, that is on canvas
+func visibleArea(canvas image.Rectangle, size, at image.Point) image.Rectangle {
+	return image.Rectangle{Max: size}.Intersect(canvas.Sub(at))
+}
+
+/*
+stamp :
+Composites overlay over canvas with its top left corner at at, both premultiplied,
+its alpha multiplied by opacity. The parts of the overlay outside of the canvas are left out,
+overlay may only have the visibleArea
+*/
+func stamp(canvas, overlay *image.RGBA, at image.Point, opacity float64) {
+	area := overlay.Rect.Add(at).Intersect(canvas.Rect)
+
+	parallelRows(area.Dy(), func(minY, maxY int) {
+		for y := area.Min.Y + minY; y < area.Min.Y+maxY; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				dst := canvas.Pix[canvas.PixOffset(x, y):]
+				src := overlay.Pix[overlay.PixOffset(x-at.X, y-at.Y):]
+				// the share of the canvas showing through the overlay
+				through := 1 - float64(src[3])*opacity/255
+
+				for c := 0; c < 4; c++ {
+					dst[c] = clamp(float64(src[c])*opacity + float64(dst[c])*through)
+				}
+			}
+		}
+	})
+}
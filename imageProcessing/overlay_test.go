@@ -0,0 +1,85 @@
+package imageProcessing
+
+import (
+	"bytes"
+	"image"
+	"runtime"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// testPattern : a translucent img with a different color for each pixel
+func testPattern(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+
+		if i%4 == 3 {
+			img.Pix[i] = 0xff - uint8(i%64)
+		}
+	}
+
+	// premultiplied
+	for i := 0; i < len(img.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = uint8(int(img.Pix[i+c]) * int(img.Pix[i+3]) / 0xff)
+		}
+	}
+
+	return img
+}
+
+func TestResampleArea(t *testing.T) {
+	src := testPattern(13, 9)
+	whole := resample(src, 40, 25, kernels["lanczos"])
+
+	for _, area := range []image.Rectangle{image.Rect(0, 0, 40, 25), image.Rect(5, 3, 17, 20), image.Rect(39, 24, 40, 25), {}} {
+		part := resampleArea(src, 40, 25, area, kernels["lanczos"])
+
+		if part.Rect != area {
+			t.Fatalf("bounds %v, expected %v", part.Rect, area)
+		}
+
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			if !bytes.Equal(part.Pix[part.PixOffset(area.Min.X, y):part.PixOffset(area.Max.X-1, y)+4], whole.Pix[whole.PixOffset(area.Min.X, y):whole.PixOffset(area.Max.X-1, y)+4]) {
+				t.Fatalf("row %d of %v differs from the whole image", y, area)
+			}
+		}
+	}
+}
+
+// TestWatermarkLargerThanImage : only the part of an overlay on the image is made
+func TestWatermarkLargerThanImage(t *testing.T) {
+	overlay := testPattern(2000, 2000)
+	overlays := func(name string) (image.Image, error) {
+		return overlay, nil
+	}
+
+	for _, anchor := range []string{"topLeft", "center", "bottomRight"} {
+		before := runtime.MemStats{}
+		runtime.ReadMemStats(&before)
+
+		// 20000x20000 pixels once scaled, 1.6GB as a whole
+		result, err := RunWith(testPattern(50, 30), []task.Operation{{Name: "watermark", Params: map[string]interface{}{
+			"overlay": "logo", "scale": 10.0, "anchor": anchor,
+		}}}, overlays)
+
+		after := runtime.MemStats{}
+		runtime.ReadMemStats(&after)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Bounds() != image.Rect(0, 0, 50, 30) {
+			t.Fatalf("%s: bounds %v", anchor, result.Bounds())
+		}
+
+		// the overlay, its copy, and the taps of the resize
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 200<<20 {
+			t.Errorf("%s: %d bytes allocated", anchor, allocated)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package imageProcessing
+
+import (
+	"runtime"
+	"sync"
+)
+
+// the goroutines working on an image at once
+var parallelism = runtime.GOMAXPROCS(0)
+
+// SetParallelism : how many goroutines work on an image at once, the number of CPUs when n < 1
+func SetParallelism(n int) {
+	if n < 1 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	parallelism = n
+}
+
+/*
+parallelRows :
+Splits the rows from 0 to height into bands, and calls f on each band from a pool of
+parallelism goroutines. There are a few bands per goroutine, so that a slow band
+doesn't leave the others idle
+*/
+func parallelRows(height int, f func(minY, maxY int)) {
+	workers := parallelism
+
+	if workers > height {
+		workers = height
+	}
+
+	if workers <= 1 {
+		f(0, height)
+		return
+	}
+
+	bandHeight := (height + workers*4 - 1) / (workers * 4)
+	bands := make(chan int)
+	waitGroup := sync.WaitGroup{}
+	waitGroup.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer waitGroup.Done()
+
+			for minY := range bands {
+				maxY := minY + bandHeight
+
+				if maxY > height {
+					maxY = height
+				}
+
+				f(minY, maxY)
+			}
+		}()
+	}
+
+	for minY := 0; minY < height; minY += bandHeight {
+		bands <- minY
+	}
+
+	close(bands)
+	waitGroup.Wait()
+}
@@ -0,0 +1,306 @@
+package imageProcessing
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// Param : a parameter of an operation, a number unless it has choices or is a text
+type Param struct {
+	Name     string
+	Required bool
+	// used when the parameter isn't given, a float64 for numbers
+	Default interface{}
+	Min     float64
+	Max     float64
+	Choices []string
+	// any string of Min to Max characters
+	Text bool
+}
+
+/*
+Operation :
+A named transformation of an image, which the tasks reference with their parameters.
+Check validates the parameters together, once each of them is valid.
+Overlay is the text parameter naming an overlay image, which Apply gets instead of the name
+*/
+type Operation struct {
+	Name    string
+	Params  []Param
+	Overlay string
+	Check   func(args Args) error
+	Apply   func(img image.Image, args Args) (image.Image, error)
+}
+
+// Overlays : the overlay images of a task by name, for the operations that stamp them on the image
+type Overlays func(name string) (image.Image, error)
+
+// Args : the parameters of an operation, validated and completed with their defaults
+type Args map[string]interface{}
+
+// Number : the value of a number parameter
+func (args Args) Number(name string) float64 {
+	value, _ := args[name].(float64)
+
+	return value
+}
+
+// Int : the value of a number parameter, rounded
+func (args Args) Int(name string) int {
+	return int(math.Round(args.Number(name)))
+}
+
+// String : the value of a parameter with choices or of a text parameter
+func (args Args) String(name string) string {
+	value, _ := args[name].(string)
+
+	return value
+}
+
+// Image : the overlay image of the Overlay parameter
+func (args Args) Image(name string) image.Image {
+	img, _ := args[name].(image.Image)
+
+	return img
+}
+
+// Has : whether the parameter was given or has a default
+func (args Args) Has(name string) bool {
+	_, exists := args[name]
+
+	return exists
+}
+
+var operations = make(map[string]Operation)
+
+// Register : makes an operation available to the tasks, registering a name twice is a bug
+func Register(operation Operation) {
+	if _, exists := operations[operation.Name]; exists {
+		panic("imageProcessing: operation " + operation.Name + " registered twice")
+	}
+
+	operations[operation.Name] = operation
+}
+
+// Lookup : the operation registered as name
+func Lookup(name string) (Operation, bool) {
+	operation, exists := operations[name]
+
+	return operation, exists
+}
+
+// Names : the names of the registered operations, sorted
+func Names() []string {
+	names := make([]string, 0, len(operations))
+
+	for name := range operations {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// parse : the Args of step, or why its parameters are invalid
+func (operation Operation) parse(step task.Operation) (Args, error) {
+	args := make(Args)
+	known := make(map[string]bool)
+
+	for _, param := range operation.Params {
+		known[param.Name] = true
+		value, given := step.Params[param.Name]
+
+		if !given || value == nil {
+			if param.Required {
+				return nil, fmt.Errorf("%s: missing parameter %s", operation.Name, param.Name)
+			}
+
+			if param.Default != nil {
+				args[param.Name] = param.Default
+			}
+
+			continue
+		}
+
+		parsed, err := param.parse(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s %s", operation.Name, param.Name, err.Error())
+		}
+
+		args[param.Name] = parsed
+	}
+
+	for name := range step.Params {
+		if !known[name] {
+			return nil, fmt.Errorf("%s: unknown parameter %s", operation.Name, name)
+		}
+	}
+
+	if operation.Check != nil {
+		if err := operation.Check(args); err != nil {
+			return nil, fmt.Errorf("%s: %s", operation.Name, err.Error())
+		}
+	}
+
+	return args, nil
+}
+
+func (param Param) parse(value interface{}) (interface{}, error) {
+	if param.Text {
+		text, ok := value.(string)
+
+		if !ok || float64(utf8.RuneCountInString(text)) < param.Min || float64(utf8.RuneCountInString(text)) > param.Max {
+			return nil, fmt.Errorf("must be a text of %g to %g characters", param.Min, param.Max)
+		}
+
+		return text, nil
+	}
+
+	if len(param.Choices) != 0 {
+		choice, ok := value.(string)
+
+		for _, allowed := range param.Choices {
+			if ok && choice == allowed {
+				return choice, nil
+			}
+		}
+
+		return nil, errors.New("must be one of " + strings.Join(param.Choices, ", "))
+	}
+
+	var number float64
+
+	switch typed := value.(type) {
+	case float64:
+		number = typed
+	case int:
+		number = float64(typed)
+	default:
+		return nil, errors.New("must be a number")
+	}
+
+	if math.IsNaN(number) || number < param.Min || number > param.Max {
+		return nil, fmt.Errorf("must be between %g and %g", param.Min, param.Max)
+	}
+
+	return number, nil
+}
+
+// Validate : checks that every step is a registered operation with valid parameters
+func Validate(steps []task.Operation) error {
+	_, err := prepare(steps)
+
+	return err
+}
+
+type preparedStep struct {
+	operation Operation
+	args      Args
+}
+
+// the most operations a task may apply, so that no task keeps a worker busy for too long
+const maxOperations = 32
+
+func prepare(steps []task.Operation) ([]preparedStep, error) {
+	if len(steps) > maxOperations {
+		return nil, fmt.Errorf("%d operations, a task applies at most %d", len(steps), maxOperations)
+	}
+
+	prepared := make([]preparedStep, 0, len(steps))
+
+	for i, step := range steps {
+		operation, exists := operations[step.Name]
+
+		if !exists {
+			return nil, fmt.Errorf("operation %d: unknown operation %q, expected one of %s",
+				i, step.Name, strings.Join(Names(), ", "))
+		}
+
+		args, err := operation.parse(step)
+
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err.Error())
+		}
+
+		prepared = append(prepared, preparedStep{operation: operation, args: args})
+	}
+
+	return prepared, nil
+}
+
+// OverlaysOf : the names of the overlay images the steps use, which have to be valid
+func OverlaysOf(steps []task.Operation) []string {
+	prepared, _ := prepare(steps)
+	names := []string{}
+
+	for _, step := range prepared {
+		if len(step.operation.Overlay) != 0 {
+			names = append(names, step.args.String(step.operation.Overlay))
+		}
+	}
+
+	return names
+}
+
+// Run : applies the steps in order, after validating all of them, without overlay images
+func Run(img image.Image, steps []task.Operation) (image.Image, error) {
+	return RunWith(img, steps, nil)
+}
+
+/*
+RunWith :
+Applies the steps in order, after validating all of them, finding their overlay images with overlays.
+An Animation has the steps applied to each of its frames
+*/
+func RunWith(img image.Image, steps []task.Operation, overlays Overlays) (image.Image, error) {
+	prepared, err := prepare(steps)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, step := range prepared {
+		if name := step.operation.Overlay; len(name) != 0 {
+			if overlays == nil {
+				return nil, fmt.Errorf("operation %d: %s: no overlay images", i, step.operation.Name)
+			}
+
+			if step.args[name], err = overlays(step.args.String(name)); err != nil {
+				return nil, fmt.Errorf("operation %d: %s: %s", i, step.operation.Name, err.Error())
+			}
+		}
+
+	}
+
+	if animation, animated := img.(*Animation); animated {
+		return animation.eachFrame(func(frame image.Image) (image.Image, error) {
+			return apply(frame, prepared)
+		})
+	}
+
+	return apply(img, prepared)
+}
+
+// apply : applies the prepared steps in order, their overlay images already found
+func apply(img image.Image, prepared []preparedStep) (image.Image, error) {
+	var err error
+
+	for i, step := range prepared {
+		img, err = step.operation.Apply(img, step.args)
+
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %s: %s", i, step.operation.Name, err.Error())
+		}
+	}
+
+	return img, nil
+}
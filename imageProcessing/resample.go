@@ -0,0 +1,188 @@
+package imageProcessing
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+/*
+Kernel :
+A resampling filter, weighing the source pixels up to Support pixels away from
+the center of a destination pixel. When shrinking, it is stretched to cover every source pixel.
+Nearest has no support and takes the closest pixel
+*/
+type Kernel struct {
+	Name    string
+	Support float64
+	At      func(x float64) float64
+}
+
+// DefaultKernel : the kernel of the resize operation when it doesn't choose one
+const DefaultKernel = "bilinear"
+
+var kernels = map[string]Kernel{
+	"nearest": {Name: "nearest"},
+	"bilinear": {
+		Name:    "bilinear",
+		Support: 1,
+		At: func(x float64) float64 {
+			return 1 - math.Abs(x)
+		},
+	},
+	// the cubic with a = -0.5, sharper than bilinear without the ringing of Lanczos
+	"catmullRom": {
+		Name:    "catmullRom",
+		Support: 2,
+		At: func(x float64) float64 {
+			x = math.Abs(x)
+
+			if x < 1 {
+				return (1.5*x-2.5)*x*x + 1
+			}
+
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		},
+	},
+	// 3 lobes, the sharpest when shrinking photos
+	"lanczos": {
+		Name:    "lanczos",
+		Support: 3,
+		At: func(x float64) float64 {
+			if x == 0 {
+				return 1
+			}
+
+			x *= math.Pi
+
+			return 3 * math.Sin(x) * math.Sin(x/3) / (x * x)
+		},
+	},
+}
+
+// KernelNames : the names of the kernels, sorted
+func KernelNames() []string {
+	names := make([]string, 0, len(kernels))
+
+	for name := range kernels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// tap : the weights of the source pixels from first, making one destination pixel
+type tap struct {
+	first   int
+	weights []float64
+}
+
+// taps : for each of the size destination pixels, the srcSize source pixels it is made of
+func (kernel Kernel) taps(srcSize, size int) []tap {
+	scale := float64(srcSize) / float64(size)
+	taps := make([]tap, size)
+
+	if kernel.Support == 0 {
+		for i := range taps {
+			taps[i] = tap{first: clampInt(int((float64(i)+0.5)*scale), 0, srcSize-1), weights: []float64{1}}
+		}
+
+		return taps
+	}
+
+	stretch := math.Max(1, scale)
+	radius := kernel.Support * stretch
+
+	for i := range taps {
+		center := (float64(i)+0.5)*scale - 0.5
+		first := int(math.Ceil(center - radius))
+		last := int(math.Floor(center + radius))
+		weights := make([]float64, 0, last-first+1)
+		sum := 0.0
+
+		for j := first; j <= last; j++ {
+			weight := kernel.At((float64(j) - center) / stretch)
+			weights = append(weights, weight)
+			sum += weight
+		}
+
+		for j := range weights {
+			weights[j] /= sum
+		}
+
+		taps[i] = tap{first: first, weights: weights}
+	}
+
+	return taps
+}
+
+/*
+resample :
+Resizes the rows then the columns, the edge pixels are repeated beyond the borders.
+The colors are premultiplied so that transparent pixels don't bleed into the others,
+and kept below the alpha where the kernel overshoots
+*/
+func resample(src *image.RGBA, width, height int, kernel Kernel) *image.RGBA {
+	return resampleArea(src, width, height, image.Rect(0, 0, width, height), kernel)
+}
+
+/*
+resampleArea :
+The area of src resized to width x height, as resample, without making the rest of it.
+The image returned has area as its bounds
+*/
+func resampleArea(src *image.RGBA, width, height int, area image.Rectangle, kernel Kernel) *image.RGBA {
+	srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+	columns, lines := kernel.taps(srcWidth, width)[area.Min.X:area.Max.X], kernel.taps(srcHeight, height)[area.Min.Y:area.Max.Y]
+	areaWidth := area.Dx()
+	rows := make([]float64, areaWidth*srcHeight*4)
+
+	parallelRows(srcHeight, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x, column := range columns {
+				for c := 0; c < 4; c++ {
+					sum := 0.0
+
+					for i, weight := range column.weights {
+						sx := clampInt(column.first+i, 0, srcWidth-1)
+						sum += float64(src.Pix[y*src.Stride+sx*4+c]) * weight
+					}
+
+					rows[(y*areaWidth+x)*4+c] = sum
+				}
+			}
+		}
+	})
+
+	dst := image.NewRGBA(area)
+
+	parallelRows(area.Dy(), func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			line := lines[y]
+
+			for x := 0; x < areaWidth; x++ {
+				var sums [4]float64
+
+				for i, weight := range line.weights {
+					sy := clampInt(line.first+i, 0, srcHeight-1)
+
+					for c := 0; c < 4; c++ {
+						sums[c] += rows[(sy*areaWidth+x)*4+c] * weight
+					}
+				}
+
+				i := y*dst.Stride + x*4
+				alpha := clamp(sums[3])
+				dst.Pix[i+3] = alpha
+
+				for c := 0; c < 3; c++ {
+					dst.Pix[i+c] = clamp(math.Min(sums[c], float64(alpha)))
+				}
+			}
+		}
+	})
+
+	return dst
+}
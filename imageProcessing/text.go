@@ -0,0 +1,148 @@
+package imageProcessing
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Go Regular, the TrueType font bundled with golang.org/x/image, parsed once
+var (
+	textFont      *opentype.Font
+	textFontError error
+	textFontOnce  sync.Once
+)
+
+func init() {
+	// size: of the font in pixels, color: #rrggbb or #rrggbbaa, the lines are split on \n
+	Register(Operation{
+		Name: "text",
+		Params: []Param{
+			{Name: "text", Required: true, Text: true, Min: 1, Max: 500},
+			{Name: "size", Default: 24.0, Min: 4, Max: 1000},
+			{Name: "color", Default: "#ffffff", Text: true, Min: 1, Max: 9},
+			{Name: "anchor", Default: "bottomLeft", Choices: anchors},
+			{Name: "opacity", Default: 1.0, Min: 0, Max: 1},
+			{Name: "margin", Default: 10.0, Min: 0, Max: maxSide},
+		},
+		Check: func(args Args) error {
+			// every glyph is rasterized at its size, even off the image
+			characters := utf8.RuneCountInString(strings.Replace(args.String("text"), "\n", "", -1))
+			size := args.Number("size")
+
+			if pixels := float64(characters) * size * size; pixels > float64(ResultLimits.MaxPixels) {
+				return LimitError{fmt.Sprintf("%d characters of size %g, over the limit of %d pixels", characters, size, ResultLimits.MaxPixels)}
+			}
+
+			_, err := parseColor(args.String("color"))
+
+			return err
+		},
+		Apply: func(img image.Image, args Args) (image.Image, error) {
+			c, _ := parseColor(args.String("color"))
+			canvas := toRGBA(img)
+			at := image.Point{}
+			// only the part on the image is drawn, at most as large as the image
+			label, err := renderText(args.String("text"), args.Number("size"), c, func(size image.Point) image.Rectangle {
+				at = anchorPoint(args.String("anchor"), canvas.Rect.Size(), size, args.Int("margin"))
+
+				return visibleArea(canvas.Rect, size, at)
+			})
+
+			if err != nil {
+				return nil, err
+			}
+
+			stamp(canvas, label, at, args.Number("opacity"))
+
+			return canvas, nil
+		},
+	})
+}
+
+// parseColor : the color written as #rrggbb, or #rrggbbaa with its alpha
+func parseColor(hex string) (color.NRGBA, error) {
+	invalid := errors.New("color must be written as #rrggbb or #rrggbbaa")
+
+	if (len(hex) != 7 && len(hex) != 9) || hex[0] != '#' {
+		return color.NRGBA{}, invalid
+	}
+
+	value, err := strconv.ParseUint(hex[1:], 16, 32)
+
+	if err != nil {
+		return color.NRGBA{}, invalid
+	}
+
+	if len(hex) == 7 {
+		value = value<<8 | 0xff
+	}
+
+	return color.NRGBA{R: uint8(value >> 24), G: uint8(value >> 16), B: uint8(value >> 8), A: uint8(value)}, nil
+}
+
+/*
+renderText :
+The lines of text drawn in c on a transparent image just big enough for them,
+premultiplied to be stamped on another image. Only the area that area returns
+for the size of the whole image is drawn, the image returned having it as its bounds
+*/
+func renderText(text string, size float64, c color.NRGBA, area func(size image.Point) image.Rectangle) (*image.RGBA, error) {
+	textFontOnce.Do(func() {
+		textFont, textFontError = opentype.Parse(goregular.TTF)
+	})
+
+	if textFontError != nil {
+		return nil, textFontError
+	}
+
+	face, err := opentype.NewFace(textFont, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingNone})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer face.Close()
+
+	metrics := face.Metrics()
+	lines := strings.Split(text, "\n")
+	lineHeight := metrics.Height.Ceil()
+	width := 1
+
+	for _, line := range lines {
+		if advance := font.MeasureString(face, line).Ceil(); advance > width {
+			width = advance
+		}
+	}
+
+	mask := image.NewAlpha(area(image.Point{X: clampInt(width, 1, maxSide), Y: clampInt(lineHeight*len(lines), 1, maxSide)}))
+	drawer := font.Drawer{Dst: mask, Src: image.Opaque, Face: face}
+
+	for i, line := range lines {
+		drawer.Dot = fixed.Point26_6{X: 0, Y: fixed.I(i*lineHeight) + metrics.Ascent}
+		drawer.DrawString(line)
+	}
+
+	label := image.NewRGBA(mask.Rect)
+
+	// both start at the top left corner of the area
+	for i, coverage := range mask.Pix {
+		alpha := float64(coverage) * float64(c.A) / 255
+		label.Pix[i*4] = clamp(float64(c.R) * alpha / 255)
+		label.Pix[i*4+1] = clamp(float64(c.G) * alpha / 255)
+		label.Pix[i*4+2] = clamp(float64(c.B) * alpha / 255)
+		label.Pix[i*4+3] = clamp(alpha)
+	}
+
+	return label, nil
+}
@@ -0,0 +1,100 @@
+package imageProcessing
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// TestTextArea : a part of a label is drawn as it is in the whole label
+func TestTextArea(t *testing.T) {
+	c := color.NRGBA{R: 0xff, G: 0xcc, A: 0x80}
+	whole, err := renderText("Golden\nimage", 30, c, func(size image.Point) image.Rectangle {
+		return image.Rectangle{Max: size}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	area := image.Rect(20, 10, 60, 40)
+	part, err := renderText("Golden\nimage", 30, c, func(size image.Point) image.Rectangle {
+		if size != whole.Rect.Size() {
+			t.Fatalf("size %v, expected %v", size, whole.Rect.Size())
+		}
+
+		return area
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if part.Rect != area {
+		t.Fatalf("bounds %v, expected %v", part.Rect, area)
+	}
+
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			if part.RGBAAt(x, y) != whole.RGBAAt(x, y) {
+				t.Fatalf("pixel %d,%d is %v, expected %v", x, y, part.RGBAAt(x, y), whole.RGBAAt(x, y))
+			}
+		}
+	}
+}
+
+// TestTextLargerThanImage : only the part of a label on the image is drawn
+func TestTextLargerThanImage(t *testing.T) {
+	// 5 lines of the largest size, about 19000x5800 pixels as a whole
+	line := strings.Repeat("W", 20)
+	text := strings.Repeat(line+"\n", 4) + line
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+
+	result, err := Run(testPattern(50, 30), []task.Operation{{Name: "text", Params: map[string]interface{}{"text": text, "size": 1000.0, "anchor": "center"}}})
+
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Bounds() != image.Rect(0, 0, 50, 30) {
+		t.Fatalf("bounds %v", result.Bounds())
+	}
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 100<<20 {
+		t.Errorf("%d bytes allocated", allocated)
+	}
+}
+
+// TestTextLimit : the glyphs of a text are at most ResultLimits.MaxPixels, whatever part of it is on the image
+func TestTextLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		size    float64
+		invalid bool
+	}{
+		{name: "the largest size", text: strings.Repeat("W", 100), size: 1000},
+		{name: "the most characters", text: strings.Repeat("W", 500), size: 447},
+		{name: "lines not counted", text: strings.Repeat("W\n", 99) + "W", size: 1000},
+		{name: "the most characters of the largest size", text: strings.Repeat("W", 500), size: 1000, invalid: true},
+		{name: "one character too many", text: strings.Repeat("W", 101), size: 1000, invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate([]task.Operation{{Name: "text", Params: map[string]interface{}{"text": test.text, "size": test.size}}})
+
+			if invalid := err != nil; invalid != test.invalid {
+				t.Fatalf("invalid %v, expected %v: %v", invalid, test.invalid, err)
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/tsauvajon/go-microservices-poc/errorHandling"
@@ -79,8 +81,15 @@ func set(w http.ResponseWriter, r *http.Request) {
 	}
 
 	keyValueStoreMutex.Lock()
+	defer keyValueStoreMutex.Unlock()
+
+	// compare-and-set: only replace the value if it still is ifValue, a missing key being ""
+	if expected, ok := values["ifValue"]; ok && keyValueStore[key] != expected[0] {
+		errorHandling.RespondWithStatus(w, http.StatusConflict, "the value of "+key+" changed")
+		return
+	}
+
 	keyValueStore[key] = value
-	keyValueStoreMutex.Unlock()
 
 	fmt.Fprint(w, "Success")
 }
@@ -112,15 +121,37 @@ func remove(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Success")
 }
 
+// list : responds with a JSON object of the keys starting with the optional prefix parameter
 func list(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		errorHandling.RespondOnlyXAccepted(w, "GET")
 		return
 	}
 
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	prefix := values.Get("prefix")
+	found := make(map[string]string)
+
 	keyValueStoreMutex.RLock()
 	for key, value := range keyValueStore {
-		fmt.Fprint(w, key, ": ", value)
+		if strings.HasPrefix(key, prefix) {
+			found[key] = value
+		}
 	}
 	keyValueStoreMutex.RUnlock()
+
+	response, err := json.Marshal(found)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/config"
+	"github.com/tsauvajon/go-microservices-poc/dataAccess"
+	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+var (
+	masterLocation string
+	apiKey         = config.GetString("LOADTEST_API_KEY", "")
+	// the MASTER_MAX_QUEUED_TASKS of the master, 0 to skip checking it
+	maxQueued = config.GetInt("LOADTEST_MAX_QUEUED_TASKS", 0)
+)
+
+// result : the outcome of one upload
+type result struct {
+	status     int
+	latency    time.Duration
+	retryAfter string
+}
+
+/*
+Uploads an image many times at once to the master, then reports the responses
+and fails when the admission control didn't hold:
+a 503 without Retry-After, or more queued tasks than LOADTEST_MAX_QUEUED_TASKS
+
+	loadTest <keyValueStoreAddress> <image> [uploads] [concurrency]
+*/
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Println("Error: ", "too few arguments")
+		return
+	}
+
+	uploads, concurrency := 200, 20
+
+	if len(os.Args) > 3 {
+		uploads, _ = strconv.Atoi(os.Args[3])
+	}
+
+	if len(os.Args) > 4 {
+		concurrency, _ = strconv.Atoi(os.Args[4])
+	}
+
+	if uploads < 1 || concurrency < 1 {
+		fmt.Println("Error: ", "the uploads and concurrency must be positive numbers")
+		return
+	}
+
+	value, err := dataAccess.GetValue(os.Args[1], "masterAddress")
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	masterLocation = value
+	image, err := ioutil.ReadFile(os.Args[2])
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	done := make(chan bool)
+	deepest := make(chan int)
+	go watchQueueDepth(done, deepest)
+
+	results := run(image, uploads, concurrency)
+
+	close(done)
+
+	if !report(results, <-deepest) {
+		os.Exit(1)
+	}
+}
+
+// run : uploads the image, concurrency uploads at a time
+func run(image []byte, uploads, concurrency int) []result {
+	results := make([]result, uploads)
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range next {
+				results[i] = upload(image)
+			}
+		}()
+	}
+
+	for i := 0; i < uploads; i++ {
+		next <- i
+	}
+
+	close(next)
+	wg.Wait()
+
+	return results
+}
+
+func upload(image []byte) result {
+	start := time.Now()
+	request, err := http.NewRequest(http.MethodPost, "http://"+masterLocation+"/newImage", bytes.NewReader(image))
+
+	if err != nil {
+		fmt.Println("Error: ", err.Error())
+		return result{}
+	}
+
+	request.Header.Set(tenant.APIKeyHeader, apiKey)
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		fmt.Println("Error: ", err.Error())
+		return result{}
+	}
+
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	return result{
+		status:     response.StatusCode,
+		latency:    time.Since(start),
+		retryAfter: response.Header.Get("Retry-After"),
+	}
+}
+
+// watchQueueDepth : sends the most tasks seen queued at once when done is closed
+func watchQueueDepth(done chan bool, deepest chan int) {
+	most := 0
+
+	for {
+		if queued := queueDepth(); queued > most {
+			most = queued
+		}
+
+		select {
+		case <-done:
+			// the last uploads may have been queued since
+			if queued := queueDepth(); queued > most {
+				most = queued
+			}
+
+			deepest <- most
+			return
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+// queueDepth : the tasks queued on every shard, 0 if the master doesn't answer
+func queueDepth() int {
+	request, err := http.NewRequest(http.MethodGet, "http://"+masterLocation+"/queueStats", nil)
+
+	if err != nil {
+		return 0
+	}
+
+	request.Header.Set(tenant.APIKeyHeader, apiKey)
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		return 0
+	}
+
+	defer response.Body.Close()
+	stats := task.QueueStats{}
+
+	if err = json.NewDecoder(response.Body).Decode(&stats); err != nil {
+		return 0
+	}
+
+	return stats.Queued
+}
+
+// report : prints the responses and latencies, returns false if the admission control didn't hold
+func report(results []result, deepest int) bool {
+	statuses := make(map[int]int)
+	latencies := []time.Duration{}
+	ok := true
+
+	for _, r := range results {
+		statuses[r.status]++
+		latencies = append(latencies, r.latency)
+
+		if r.status == http.StatusServiceUnavailable && len(r.retryAfter) == 0 {
+			ok = false
+		}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	for status, count := range statuses {
+		// 0: the request failed before getting a response
+		fmt.Println("status", status, ":", count)
+	}
+
+	fmt.Println("latency p50:", latencies[len(latencies)/2], "p99:", latencies[len(latencies)*99/100])
+	fmt.Println("most tasks queued at once:", deepest)
+
+	if !ok {
+		fmt.Println("Error: ", "a 503 came without a Retry-After header")
+	}
+
+	if maxQueued > 0 && deepest > maxQueued {
+		fmt.Println("Error: ", "the queue went over", maxQueued, "tasks")
+		ok = false
+	}
+
+	return ok
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// suggested to clients when the throughput doesn't tell when the queue will have room again
+const defaultRetryAfter = time.Second * 5
+
+var admission = &admissionControl{}
+
+/*
+admissionControl :
+Refuses new tasks while the queues of the shards are saturated:
+above maxQueued tasks not started yet, or above maxWait of estimated wait.
+New tasks may wait up to maxDelay for the queue to drain before being refused
+*/
+type admissionControl struct {
+	maxQueued int
+	maxWait   time.Duration
+	maxDelay  time.Duration
+	interval  time.Duration
+	stats     task.QueueStats
+	// tasks admitted since the stats were refreshed, which they don't count yet
+	admitted int
+	mutex    sync.Mutex
+}
+
+// watchQueue : refreshes the stats of the queue every interval, when a threshold is set
+func watchQueue(interval time.Duration, maxQueued int, maxWait, maxDelay time.Duration) {
+	admission.maxQueued = maxQueued
+	admission.maxWait = maxWait
+	admission.maxDelay = maxDelay
+	admission.interval = interval
+
+	if maxQueued <= 0 && maxWait <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			if err := admission.refresh(); err != nil {
+				fmt.Println("Error: ", "can't refresh the queue stats", err.Error())
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// shardsQueueStats : the stats of the queues of every shard added together
+func shardsQueueStats() (task.QueueStats, error) {
+	total := task.QueueStats{}
+	bodies, err := getFromEveryShard("/queueStats")
+
+	if err != nil {
+		return total, err
+	}
+
+	for _, body := range bodies {
+		stats := task.QueueStats{}
+
+		if err = json.Unmarshal(body, &stats); err != nil {
+			return total, err
+		}
+
+		total = total.Add(stats)
+	}
+
+	return total, nil
+}
+
+/*
+refresh :
+The tasks admitted while the shards answer may be missing from their stats,
+so only the ones admitted before are forgotten. The previous stats are kept if a shard doesn't answer
+*/
+func (control *admissionControl) refresh() error {
+	control.mutex.Lock()
+	before := control.admitted
+	control.mutex.Unlock()
+
+	total, err := shardsQueueStats()
+
+	if err != nil {
+		return err
+	}
+
+	control.mutex.Lock()
+	control.stats = total
+	control.admitted -= before
+	control.mutex.Unlock()
+
+	return nil
+}
+
+// current : the last stats, counting the tasks admitted since, must be called with the mutex held
+func (control *admissionControl) current() task.QueueStats {
+	stats := control.stats
+	stats.Queued += control.admitted
+	stats.EstimatedWait = task.EstimateWait(stats.Queued+stats.InProgress, stats.Throughput)
+
+	return stats
+}
+
+/*
+saturated :
+Whether admitting that many tasks would go over a threshold, must be called with the mutex held.
+Returns why, and when the queue should have room again
+*/
+func (control *admissionControl) saturated(tasks int) (reason string, retryAfter time.Duration, full bool) {
+	stats := control.current()
+
+	if control.maxQueued > 0 && stats.Queued+tasks > control.maxQueued {
+		retryAfter = defaultRetryAfter
+
+		if stats.Throughput > 0 {
+			excess := stats.Queued + tasks - control.maxQueued
+			retryAfter = time.Duration(float64(excess) / stats.Throughput * float64(time.Second))
+		}
+
+		return fmt.Sprintf("the queue is full: %d tasks queued, %d more would go over %d",
+			stats.Queued, tasks, control.maxQueued), retryAfter, true
+	}
+
+	wait := time.Duration(stats.EstimatedWait * float64(time.Second))
+
+	if control.maxWait > 0 && stats.EstimatedWait >= 0 && wait > control.maxWait {
+		return fmt.Sprintf("the queue is saturated: an estimated wait of %s, over %s",
+			wait.Round(time.Second), control.maxWait), wait - control.maxWait, true
+	}
+
+	return "", 0, false
+}
+
+/*
+admitted :
+Returns true and counts the tasks in the queue if there is room for them,
+waiting up to maxDelay for it. Otherwise responds with a 503 and a Retry-After header
+*/
+func admitted(w http.ResponseWriter, r *http.Request, tasks int) bool {
+	deadline := time.Now().Add(admission.maxDelay)
+
+	for {
+		admission.mutex.Lock()
+		reason, retryAfter, full := admission.saturated(tasks)
+
+		if !full {
+			admission.admitted += tasks
+		}
+		admission.mutex.Unlock()
+
+		if !full {
+			return true
+		}
+
+		remaining := time.Until(deadline)
+
+		if remaining <= 0 {
+			seconds := math.Max(1, math.Ceil(retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+			errorHandling.RespondWithStatus(w, http.StatusServiceUnavailable, reason)
+			return false
+		}
+
+		// the stats don't change before the next refresh
+		select {
+		case <-time.After(time.Duration(math.Min(float64(remaining), float64(admission.interval)))):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// queueStats : the stats of the queues of every shard added together, as a task.QueueStats
+func queueStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	total, err := shardsQueueStats()
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	response, err := json.Marshal(total)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
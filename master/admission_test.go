@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// testShard : a taskStore shard answering /queueStats with stats, which may be changed
+type testShard struct {
+	server *httptest.Server
+	stats  task.QueueStats
+	mutex  sync.Mutex
+}
+
+func newTestShard(t *testing.T, stats task.QueueStats) *testShard {
+	shard := &testShard{stats: stats}
+	shard.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/queueStats" {
+			http.NotFound(w, r)
+			return
+		}
+
+		shard.mutex.Lock()
+		defer shard.mutex.Unlock()
+		json.NewEncoder(w).Encode(shard.stats)
+	}))
+	t.Cleanup(shard.server.Close)
+
+	return shard
+}
+
+func (shard *testShard) setStats(stats task.QueueStats) {
+	shard.mutex.Lock()
+	shard.stats = stats
+	shard.mutex.Unlock()
+}
+
+// useShards : registers the shards, numbered in order, and forgets them once the test is over
+func useShards(t *testing.T, testShards ...*testShard) {
+	addresses := make(map[int]string)
+
+	for i, shard := range testShards {
+		addresses[i] = strings.TrimPrefix(shard.server.URL, "http://")
+	}
+
+	shards.set(addresses)
+	t.Cleanup(func() { shards.set(map[int]string{}) })
+}
+
+// useAdmission : admission control with the thresholds, its stats refreshed from the shards
+func useAdmission(t *testing.T, control *admissionControl) {
+	previous := admission
+	admission = control
+	t.Cleanup(func() { admission = previous })
+
+	if err := admission.refresh(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmitted(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxQueued int
+		maxWait   time.Duration
+		// the tasks of each request, all of them admitted but the last one when full
+		tasks      []int
+		full       bool
+		retryAfter string
+	}{
+		{name: "below the queued tasks", maxQueued: 100, tasks: []int{10, 20}},
+		{name: "up to the queued tasks", maxQueued: 100, tasks: []int{30}},
+		// 70 queued, 4 tasks per second: the 10 over the limit take 2.5s
+		{name: "above the queued tasks", maxQueued: 100, tasks: []int{20, 20}, full: true, retryAfter: "3"},
+		{name: "above the queued tasks at once", maxQueued: 100, tasks: []int{31}, full: true, retryAfter: "1"},
+		// 75 queued or in progress at 4 tasks per second: 18.75s
+		{name: "below the estimated wait", maxWait: 20 * time.Second, tasks: []int{1}},
+		// the wait before the tasks is checked: 4 more make it 19.75s, 1 more 20s, 8 more 22s, 2s over
+		{name: "above the estimated wait", maxWait: 20 * time.Second, tasks: []int{4, 1, 8, 1}, full: true, retryAfter: "2"},
+		{name: "without thresholds", tasks: []int{1000}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useShards(t,
+				newTestShard(t, task.QueueStats{Queued: 30, InProgress: 2, Throughput: 1.5}),
+				newTestShard(t, task.QueueStats{Queued: 40, InProgress: 3, Throughput: 2.5}),
+			)
+			useAdmission(t, &admissionControl{maxQueued: test.maxQueued, maxWait: test.maxWait, interval: time.Millisecond})
+
+			for i, tasks := range test.tasks {
+				w := httptest.NewRecorder()
+				ok := admitted(w, httptest.NewRequest(http.MethodPost, "/newBatch", nil), tasks)
+				last := i == len(test.tasks)-1
+
+				if test.full && last {
+					if ok || w.Code != http.StatusServiceUnavailable {
+						t.Fatalf("request %d of %d tasks admitted, expected a 503", i, tasks)
+					}
+
+					if retryAfter := w.Header().Get("Retry-After"); retryAfter != test.retryAfter {
+						t.Errorf("Retry-After %q, expected %q", retryAfter, test.retryAfter)
+					}
+
+					return
+				}
+
+				if !ok {
+					t.Fatalf("request %d of %d tasks refused with %d: %s", i, tasks, w.Code, w.Body.String())
+				}
+
+				if w.Header().Get("Retry-After") != "" {
+					t.Errorf("Retry-After on an admitted request")
+				}
+			}
+		})
+	}
+}
+
+// TestAdmittedOnceDrained : a request waits for the queue to drain, up to maxDelay
+func TestAdmittedOnceDrained(t *testing.T) {
+	shard := newTestShard(t, task.QueueStats{Queued: 100, Throughput: 10})
+	useShards(t, shard)
+	useAdmission(t, &admissionControl{maxQueued: 100, maxDelay: 5 * time.Second, interval: 10 * time.Millisecond})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		shard.setStats(task.QueueStats{Queued: 90, Throughput: 10})
+
+		if err := admission.refresh(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	w := httptest.NewRecorder()
+	started := time.Now()
+
+	if !admitted(w, httptest.NewRequest(http.MethodPost, "/newImage", nil), 10) {
+		t.Fatalf("refused with %d: %s", w.Code, w.Body.String())
+	}
+
+	if waited := time.Since(started); waited < 50*time.Millisecond || waited > 4*time.Second {
+		t.Errorf("admitted after %s", waited)
+	}
+
+	// the 10 tasks just admitted count until the next refresh
+	w = httptest.NewRecorder()
+	admission.maxDelay = 0
+
+	if admitted(w, httptest.NewRequest(http.MethodPost, "/newImage", nil), 1) || w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("admitted with the queue full")
+	}
+}
+
+// TestAdmittedShardDown : the stats are kept while a shard doesn't answer
+func TestAdmittedShardDown(t *testing.T) {
+	shard := newTestShard(t, task.QueueStats{Queued: 100, Throughput: 10})
+	useShards(t, shard)
+	useAdmission(t, &admissionControl{maxQueued: 100})
+	shard.server.Close()
+
+	if err := admission.refresh(); err == nil {
+		t.Fatal("expected an error from a shard that is down")
+	}
+
+	w := httptest.NewRecorder()
+
+	if admitted(w, httptest.NewRequest(http.MethodPost, "/newImage", nil), 1) || w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("admitted with the queue full")
+	}
+}
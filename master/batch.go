@@ -0,0 +1,343 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/imageProcessing"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// sendToStorage : stores image as the original image of the task id, among the images of owner
+func sendToStorage(id, owner, contentType string, image io.Reader) error {
+	response, err := http.Post("http://"+storageLocation+"/sendImage?id="+id+"&variant="+task.VariantOriginal+"&tenant="+owner, contentType, image)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.New("Error: " + "unexpected response from the storage => " + response.Status)
+	}
+
+	return nil
+}
+
+// getFromStorage : a variant of the images of the task id and its content type, the caller has to close the returned body
+func getFromStorage(id, owner, variant string) (io.ReadCloser, string, error) {
+	response, err := http.Get("http://" + storageLocation + "/getImage?id=" + id + "&variant=" + variant + "&tenant=" + owner)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, "", errors.New("Error: " + "unexpected response from the storage => " + response.Status)
+	}
+
+	return response.Body, response.Header.Get("Content-Type"), nil
+}
+
+/*
+newBatch :
+Expects a multipart form with any number of "images" files and of "reference" fields,
+a reference being the ID of a finished task whose result is used as input, and an optional
+"spec" field, the task.Spec of every task of the batch, validated as the spec of newImage.
+Responds with the batch ID and the ID of the task created for each image,
+files first then references, in the order they were sent. The tasks are held
+until every image is stored, those whose image couldn't be are cancelled and listed in Failed
+*/
+func newBatch(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("newBatch")
+
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	// bigger files are kept on disk until they are sent to the storage
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["images"]
+	references := r.MultipartForm.Value["reference"]
+
+	for _, reference := range references {
+		if err := task.ValidateID(reference); err != nil {
+			errorHandling.RespondWithError(w, "invalid reference: "+reference)
+			return
+		}
+	}
+
+	spec, err := specParameter(url.Values(r.MultipartForm.Value), callerOf(r).ID)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	contentTypes := make([]string, len(files))
+
+	for i, header := range files {
+		file, err := header.Open()
+
+		if err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+
+		contentType, ok := checkUpload(w, file, header.Size)
+		file.Close()
+
+		if !ok {
+			return
+		}
+
+		contentTypes[i] = contentType
+	}
+
+	count := len(files) + len(references)
+
+	if count == 0 {
+		errorHandling.RespondWithError(w, "a batch needs at least one image or reference")
+		return
+	}
+
+	if !admitted(w, r, count) || !withinQuota(w, r, count) {
+		return
+	}
+
+	database, err := shards.forKey(shardKey(r.Header.Get(idempotencyKeyHeader)))
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// workers can't take the tasks before their images are stored
+	response, err := http.Post("http://"+database+scoped(r, "/newBatch?held=true&count="+strconv.Itoa(count)), "application/json", bytes.NewReader(spec))
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		errorHandling.RespondWithError(w, string(data))
+		return
+	}
+
+	created := task.BatchCreated{}
+
+	if err = json.Unmarshal(data, &created); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// the tasks exist from now on: one image that can't be stored doesn't stop the others
+	for i, header := range files {
+		file, err := header.Open()
+
+		if err == nil {
+			err = sendToStorage(created.TaskIDs[i], callerOf(r).ID, contentTypes[i], file)
+			file.Close()
+		}
+
+		if err != nil {
+			uploadFailed(r, database, &created, created.TaskIDs[i], err)
+		}
+	}
+
+	for i, reference := range references {
+		// a tenant can only reference its own images
+		image, contentType, err := getFromStorage(reference, callerOf(r).ID, task.VariantResult)
+
+		if err == nil {
+			err = sendToStorage(created.TaskIDs[len(files)+i], callerOf(r).ID, contentType, image)
+			image.Close()
+		}
+
+		if err != nil {
+			uploadFailed(r, database, &created, created.TaskIDs[len(files)+i], err)
+		}
+	}
+
+	if err = releaseBatch(r, database, created.ID); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	data, err = json.Marshal(created)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(data))
+}
+
+// releaseBatch : gives the tasks of the batch to the workers, once every image is stored
+func releaseBatch(r *http.Request, database, id string) error {
+	response, err := http.Post("http://"+database+scoped(r, "/releaseBatch?id="+id), "", nil)
+
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.New("Error: " + "can't release the batch " + id + " => " + response.Status)
+	}
+
+	return nil
+}
+
+// uploadFailed : cancels the task of the batch whose image couldn't be stored, before a worker fails on it, and reports it
+func uploadFailed(r *http.Request, database string, created *task.BatchCreated, id string, err error) {
+	fmt.Println("Error: ", "can't store the image of task", id, err.Error())
+
+	if created.Failed == nil {
+		created.Failed = make(map[string]string)
+	}
+
+	created.Failed[id] = err.Error()
+
+	response, err := http.Post("http://"+database+scoped(r, "/cancelTask?id="+id), "", nil)
+
+	if err != nil {
+		fmt.Println("Error: ", "can't cancel task", id, err.Error())
+		return
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		fmt.Println("Error: ", "can't cancel task", id, "=>", response.Status)
+	}
+}
+
+func getBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	id, err := idParameter(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	proxyToShardOf(w, id, http.MethodGet, scoped(r, "/getBatch?id="+id), nil)
+}
+
+// getBatchResult : responds with a zip archive of the images of the batch that are finished
+func getBatchResult(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("getBatchResult")
+
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	id, err := idParameter(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	database, err := shards.forID(id)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	response, err := http.Get("http://" + database + scoped(r, "/getBatch?id="+id))
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		errorHandling.RespondWithError(w, string(data))
+		return
+	}
+
+	batch := task.Batch{}
+
+	if err = json.Unmarshal(data, &batch); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"batch-"+id+".zip\"")
+
+	archive := zip.NewWriter(w)
+	defer archive.Close()
+
+	// the headers are already sent: errors can only be logged from here
+	for _, t := range batch.Tasks {
+		if t.State != task.StatusFinished {
+			continue
+		}
+
+		image, contentType, err := getFromStorage(t.ID, t.Tenant, task.VariantResult)
+
+		if err != nil {
+			fmt.Println("Error: ", "getBatchResult => getFromStorage", t.ID, err.Error())
+			continue
+		}
+
+		entry, err := archive.Create(t.ID + imageProcessing.Extension(contentType))
+
+		if err == nil {
+			_, err = io.Copy(entry, image)
+		}
+
+		image.Close()
+
+		if err != nil {
+			fmt.Println("Error: ", "getBatchResult => io.Copy", t.ID, err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// TestNewBatchUploadFailed : the tasks whose image can't be stored are cancelled and reported, the others released once stored
+func TestNewBatchUploadFailed(t *testing.T) {
+	ids := task.NewIDGenerator(0)
+	created := task.BatchCreated{ID: ids.New(), TaskIDs: []string{ids.New(), ids.New(), ids.New()}}
+	reference := ids.New()
+	cancelled := []string{}
+	held, released, uploadedReleased := false, false, false
+	mutex := sync.Mutex{}
+
+	shard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/queueStats":
+			json.NewEncoder(w).Encode(task.QueueStats{})
+		case "/newBatch":
+			held = r.URL.Query().Get("held") == "true"
+			json.NewEncoder(w).Encode(created)
+		case "/releaseBatch":
+			mutex.Lock()
+			released = r.URL.Query().Get("id") == created.ID
+			mutex.Unlock()
+		case "/cancelTask":
+			mutex.Lock()
+			cancelled = append(cancelled, r.URL.Query().Get("id"))
+			mutex.Unlock()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer shard.Close()
+
+	// the storage fails on the second image and doesn't have the referenced one
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		uploadedReleased = uploadedReleased || released
+		mutex.Unlock()
+
+		if r.URL.Path == "/getImage" || r.URL.Query().Get("id") == created.TaskIDs[1] {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer storage.Close()
+
+	previous := storageLocation
+	storageLocation = strings.TrimPrefix(storage.URL, "http://")
+	defer func() { storageLocation = previous }()
+
+	shards.set(map[int]string{0: strings.TrimPrefix(shard.URL, "http://")})
+	defer shards.set(map[int]string{})
+	useAdmission(t, &admissionControl{})
+
+	body := bytes.Buffer{}
+	form := multipart.NewWriter(&body)
+
+	for _, name := range []string{"a.png", "b.png"} {
+		file, _ := form.CreateFormFile("images", name)
+
+		if err := png.Encode(file, image.NewNRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	form.WriteField("reference", reference)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/newBatch", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	newBatch(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d: %s", w.Code, w.Body.String())
+	}
+
+	response := task.BatchCreated{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := []string{}
+
+	for id := range response.Failed {
+		failed = append(failed, id)
+	}
+
+	expected := append([]string{}, created.TaskIDs[1:]...)
+	sort.Strings(expected)
+	sort.Strings(failed)
+	sort.Strings(cancelled)
+
+	if !reflect.DeepEqual(failed, expected) || !reflect.DeepEqual(cancelled, expected) {
+		t.Fatalf("failed %v and cancelled %v, expected %v", failed, cancelled, expected)
+	}
+
+	if !held || !released || uploadedReleased {
+		t.Errorf("held %v, released %v, an image stored after the release %v", held, released, uploadedReleased)
+	}
+
+	if !reflect.DeepEqual(response.TaskIDs, created.TaskIDs) {
+		t.Errorf("tasks %v, expected %v", response.TaskIDs, created.TaskIDs)
+	}
+}
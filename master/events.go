@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+)
+
+/*
+eventsShard :
+Event IDs are only consecutive within a shard, so a stream comes from a single shard:
+the one owning the taskId, batchId or workflowId filter, or the only one there is
+*/
+func eventsShard(r *http.Request) (string, error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, filter := range []string{"taskId", "batchId", "workflowId"} {
+		if id := values.Get(filter); len(id) != 0 {
+			return shards.forID(id)
+		}
+	}
+
+	databases := shards.all()
+
+	if len(databases) != 1 {
+		return "", errors.New("a taskId, batchId or workflowId is required when the taskStore is sharded")
+	}
+
+	return databases[0], nil
+}
+
+/*
+events :
+Relays the taskStore's Server-Sent Events stream (see taskStore/events.go),
+with the same taskId, batchId and workflowId filters and Last-Event-ID resume
+*/
+func events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		errorHandling.RespondWithError(w, "streaming not supported")
+		return
+	}
+
+	database, err := eventsShard(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+database+scoped(r, "/events?"+r.URL.RawQuery), nil)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// stop streaming from the taskStore when our client goes away
+	request = request.WithContext(r.Context())
+
+	if lastEventID := r.Header.Get("Last-Event-ID"); len(lastEventID) != 0 {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	defer response.Body.Close()
+
+	for _, header := range []string{"Content-Type", "Cache-Control", "Connection"} {
+		w.Header().Set(header, response.Header.Get(header))
+	}
+
+	w.WriteHeader(response.StatusCode)
+	flusher.Flush()
+
+	buffer := make([]byte, 4096)
+
+	for {
+		n, err := response.Body.Read(buffer)
+
+		if n > 0 {
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+		if err != nil {
+			fmt.Println("events stream ended:", err.Error())
+			return
+		}
+	}
+}
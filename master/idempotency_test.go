@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// testIdempotentShard : a taskStore shard creating tasks once per Idempotency-Key, with queue stats which may be full
+type testIdempotentShard struct {
+	server  *httptest.Server
+	ids     *task.IDGenerator
+	tasks   map[string]string
+	created int
+	mutex   sync.Mutex
+}
+
+func newTestIdempotentShard(t *testing.T, number int, stats task.QueueStats) *testIdempotentShard {
+	shard := &testIdempotentShard{ids: task.NewIDGenerator(number), tasks: make(map[string]string)}
+	shard.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+
+		shard.mutex.Lock()
+		defer shard.mutex.Unlock()
+		id, known := shard.tasks[key]
+
+		switch r.URL.Path {
+		case "/queueStats":
+			json.NewEncoder(w).Encode(stats)
+		case "/getByIdempotencyKey":
+			if !known {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Write([]byte(id))
+		case "/newTask":
+			if known {
+				w.Header().Set(idempotentReplayedHeader, "true")
+			} else {
+				id = shard.ids.New()
+				shard.created++
+
+				if len(key) != 0 {
+					shard.tasks[key] = id
+				}
+			}
+
+			w.Write([]byte(id))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(shard.server.Close)
+
+	return shard
+}
+
+func (shard *testIdempotentShard) address() string {
+	return strings.TrimPrefix(shard.server.URL, "http://")
+}
+
+// useStorage : a fileStorage accepting every image, returns the number of images it received
+func useStorage(t *testing.T) func() int {
+	uploaded := 0
+	mutex := sync.Mutex{}
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		uploaded++
+		mutex.Unlock()
+	}))
+	t.Cleanup(storage.Close)
+
+	previous := storageLocation
+	storageLocation = strings.TrimPrefix(storage.URL, "http://")
+	t.Cleanup(func() { storageLocation = previous })
+
+	return func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return uploaded
+	}
+}
+
+// upload : the response of the master to the upload of an image with idempotencyKey
+func upload(t *testing.T, idempotencyKey string) *httptest.ResponseRecorder {
+	body := bytes.Buffer{}
+
+	if err := png.Encode(&body, image.NewNRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/newImage", &body)
+
+	if len(idempotencyKey) != 0 {
+		r.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+
+	w := httptest.NewRecorder()
+	newImage(w, r)
+
+	return w
+}
+
+// TestNewImageReplay : a retried upload gets its task back even when new tasks aren't admitted anymore
+func TestNewImageReplay(t *testing.T) {
+	shard := newTestIdempotentShard(t, 0, task.QueueStats{})
+	uploaded := useStorage(t)
+	shards.set(map[int]string{0: shard.address()})
+	defer shards.set(map[int]string{})
+	useAdmission(t, &admissionControl{maxQueued: 10})
+
+	first := upload(t, "retry")
+
+	if first.Code != http.StatusOK {
+		t.Fatalf("%d: %s", first.Code, first.Body.String())
+	}
+
+	// the queue is full from now on
+	full := newTestIdempotentShard(t, 0, task.QueueStats{Queued: 100, Throughput: 1})
+	full.tasks = shard.tasks
+	shards.set(map[int]string{0: full.address()})
+	useAdmission(t, &admissionControl{maxQueued: 10})
+
+	tests := []struct {
+		name           string
+		idempotencyKey string
+		status         int
+	}{
+		{name: "a retry", idempotencyKey: "retry", status: http.StatusOK},
+		{name: "a new key", idempotencyKey: "new", status: http.StatusServiceUnavailable},
+		{name: "without a key", status: http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := upload(t, test.idempotencyKey)
+
+			if w.Code != test.status {
+				t.Fatalf("%d: %s, expected %d", w.Code, w.Body.String(), test.status)
+			}
+
+			if test.status == http.StatusOK && (w.Body.String() != first.Body.String() || w.Header().Get(idempotentReplayedHeader) != "true") {
+				t.Fatalf("replayed %q, expected the task %s", w.Body.String(), first.Body.String())
+			}
+		})
+	}
+
+	// the image of the retry is sent again, in case the first attempt stopped before
+	if full.created != 0 || uploaded() != 2 {
+		t.Errorf("%d tasks created and %d images uploaded, expected none and 2", full.created, uploaded())
+	}
+}
+
+// TestNewImageReplayAcrossShards : a retry gets its task back from its shard after a shard was added
+func TestNewImageReplayAcrossShards(t *testing.T) {
+	first, added := newTestIdempotentShard(t, 0, task.QueueStats{}), newTestIdempotentShard(t, 1, task.QueueStats{})
+	useStorage(t)
+	useAdmission(t, &admissionControl{})
+	defer shards.set(map[int]string{})
+
+	// a key the ring places on the added shard once it is there
+	shards.set(map[int]string{0: first.address(), 1: added.address()})
+	key := ""
+
+	for i := 0; len(key) == 0; i++ {
+		if database, _ := shards.forKey(shardKey(string(rune('a' + i)))); database == added.address() {
+			key = string(rune('a' + i))
+		}
+	}
+
+	shards.set(map[int]string{0: first.address()})
+	created := upload(t, key)
+
+	shards.set(map[int]string{0: first.address(), 1: added.address()})
+	replayed := upload(t, key)
+
+	if created.Code != http.StatusOK || replayed.Code != http.StatusOK {
+		t.Fatalf("%d then %d: %s", created.Code, replayed.Code, replayed.Body.String())
+	}
+
+	if replayed.Body.String() != created.Body.String() || replayed.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Fatalf("replayed %q, expected the task %s", replayed.Body.String(), created.Body.String())
+	}
+
+	if first.created != 1 || added.created != 0 {
+		t.Errorf("%d tasks created on the first shard and %d on the added one, expected 1 and none", first.created, added.created)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"fmt"
 
@@ -11,19 +14,29 @@ import (
 
 	"net/url"
 
-	"encoding/json"
-
 	"io"
 
+	"errors"
+
+	"github.com/tsauvajon/go-microservices-poc/config"
 	"github.com/tsauvajon/go-microservices-poc/dataAccess"
 	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/imageProcessing"
+	"github.com/tsauvajon/go-microservices-poc/plugins"
 	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	// the largest task.ImageInfo a worker may report, camera strings included
+	maxImageInfoSize = 64 << 10
 )
 
 var (
-	databaseLocation string
-	storageLocation  string
-	test             task.Task
+	storageLocation string
+	test            task.Task
 )
 
 func main() {
@@ -33,16 +46,14 @@ func main() {
 
 	keyValueStoreAddress := os.Args[2]
 
-	value, err := dataAccess.GetValue(keyValueStoreAddress, "databaseAddress")
-
-	databaseLocation = value
+	err := watchShards(keyValueStoreAddress, config.GetDuration("MASTER_SHARD_REFRESH_INTERVAL", time.Second*10))
 
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	value, err = dataAccess.GetValue(keyValueStoreAddress, "storageAddress")
+	value, err := dataAccess.GetValue(keyValueStoreAddress, "storageAddress")
 
 	storageLocation = value
 
@@ -51,13 +62,73 @@ func main() {
 		return
 	}
 
-	http.HandleFunc("/newImage", newImage)
-	http.HandleFunc("/getImage", getImage)
-	http.HandleFunc("/isReady", isReady)
-	http.HandleFunc("/getNewTask", getNewTask)
-	http.HandleFunc("/registerTaskFinished", registerTaskFinished)
+	tenants, err = tenant.Load(config.GetString("TENANTS_FILE", ""))
+
+	if err != nil {
+		fmt.Println("Error: ", "can't load the tenants", err.Error())
+		return
+	}
+
+	err = watchRateLimits(
+		config.GetString("MASTER_RATE_LIMITS_FILE", ""),
+		config.GetDuration("MASTER_RATE_LIMITS_RELOAD_INTERVAL", time.Second*10),
+	)
+
+	if err != nil {
+		fmt.Println("Error: ", "can't load the rate limits", err.Error())
+		return
+	}
 
-	http.ListenAndServe(":3333", nil)
+	// the same plugins as the workers, for the specs using them to be valid
+	if _, err = plugins.Load(config.GetString("MASTER_PLUGIN_DIRECTORY", "")); err != nil {
+		fmt.Println("Error: ", "can't load the plugins", err.Error())
+		return
+	}
+
+	uploadLimits = imageProcessing.Limits{
+		MaxBytes:  int64(config.GetInt("MASTER_MAX_UPLOAD_BYTES", 20000000)),
+		MaxWidth:  config.GetInt("MASTER_MAX_IMAGE_WIDTH", 10000),
+		MaxHeight: config.GetInt("MASTER_MAX_IMAGE_HEIGHT", 10000),
+		MaxPixels: int64(config.GetInt("MASTER_MAX_IMAGE_PIXELS", 40000000)),
+	}
+
+	watchQueue(
+		config.GetDuration("MASTER_QUEUE_STATS_INTERVAL", time.Second),
+		config.GetInt("MASTER_MAX_QUEUED_TASKS", 0),
+		config.GetDuration("MASTER_MAX_ESTIMATED_WAIT", 0),
+		config.GetDuration("MASTER_ADMISSION_MAX_DELAY", 0),
+	)
+
+	webhooks = newWebhookSender(
+		config.GetString("MASTER_WEBHOOK_SECRET", ""),
+		&http.Client{Timeout: time.Second * 10},
+		config.GetInt("MASTER_WEBHOOK_MAX_ATTEMPTS", 5),
+		config.GetDuration("MASTER_WEBHOOK_BACKOFF", time.Second),
+	)
+
+	http.HandleFunc("/newImage", forTenants(newImage))
+	http.HandleFunc("/getImage", forTenants(getImage))
+	http.HandleFunc("/listImages", forTenants(listImages))
+	http.HandleFunc("/newOverlay", forTenants(newOverlay))
+	http.HandleFunc("/listOverlays", forTenants(listOverlays))
+	http.HandleFunc("/deleteOverlay", forTenants(deleteOverlay))
+	http.HandleFunc("/isReady", forTenants(isReady))
+	http.HandleFunc("/getNewTask", forServices(getNewTask))
+	http.HandleFunc("/registerTaskFinished", forServices(registerTaskFinished))
+	http.HandleFunc("/registerTaskFailed", forServices(registerTaskFailed))
+	http.HandleFunc("/cancelTask", forTenants(cancelTask))
+	http.HandleFunc("/newWorkflow", forTenants(newWorkflow))
+	http.HandleFunc("/getWorkflow", forTenants(getWorkflow))
+	http.HandleFunc("/newBatch", forTenants(newBatch))
+	http.HandleFunc("/getBatch", forTenants(getBatch))
+	http.HandleFunc("/getBatchResult", forTenants(getBatchResult))
+	http.HandleFunc("/events", forTenants(events))
+	http.HandleFunc("/webhookDeliveries", forTenants(webhookDeliveries))
+	http.HandleFunc("/gcReport", forServices(gcReport))
+	http.HandleFunc("/listTasks", forTenants(listTasks))
+	http.HandleFunc("/queueStats", forTenants(queueStats))
+
+	http.ListenAndServe(":3333", rateLimited(http.DefaultServeMux))
 }
 
 func newImage(w http.ResponseWriter, r *http.Request) {
@@ -68,7 +139,66 @@ func newImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := http.Post("http://"+databaseLocation+"/newTask", "text/plain", nil)
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// optional URL notified with a webhook once the task is done
+	callback := values.Get("callback")
+
+	if len(callback) != 0 {
+		if err = validateCallback(callback); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+	}
+
+	// optional task.Spec, the operations and output of the task
+	spec, err := specParameter(values, callerOf(r).ID)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// a bad upload never becomes a task
+	image, contentType, ok := readUpload(w, r.Body)
+
+	if !ok {
+		return
+	}
+
+	// a retried upload carrying the same key gets the task created the first time
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+
+	database, replayed, err := idempotentShard(r, idempotencyKey)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// the task of a retry already went through admission and the quota
+
+	if len(replayed) == 0 && (!admitted(w, r, 1) || !withinQuota(w, r, 1)) {
+		return
+	}
+
+	request, err := http.NewRequest(http.MethodPost, "http://"+database+scoped(r, "/newTask?callback="+url.QueryEscape(callback)), bytes.NewReader(spec))
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	if len(idempotencyKey) != 0 {
+		request.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+
+	response, err := http.DefaultClient.Do(request)
 
 	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
@@ -83,11 +213,20 @@ func newImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println("Image id :", id)
+	if response.StatusCode != http.StatusOK {
+		errorHandling.RespondWithError(w, string(id))
+		return
+	}
 
-	_, err = http.Post("http://"+storageLocation+"/sendImage?id="+string(id)+"&state=working", "image", r.Body)
+	fmt.Println("Image id :", string(id))
 
-	if err != nil {
+	if replayed := response.Header.Get(idempotentReplayedHeader); len(replayed) != 0 {
+		w.Header().Set(idempotentReplayedHeader, replayed)
+	}
+
+	// the image is sent again on a replay: the first attempt may have failed
+	// after the task was created but before the upload completed
+	if err = sendToStorage(string(id), callerOf(r).ID, contentType, bytes.NewReader(image)); err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
@@ -95,6 +234,104 @@ func newImage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(id))
 }
 
+/*
+idempotentShard :
+The shard holding the task a previous request with idempotencyKey created, and the ID of the task.
+Every shard is asked, as the ring may have changed since. A new key gets the shard the ring places it on
+*/
+func idempotentShard(r *http.Request, idempotencyKey string) (database, id string, err error) {
+	placed, err := shards.forKey(shardKey(idempotencyKey))
+
+	if err != nil || len(idempotencyKey) == 0 {
+		return placed, "", err
+	}
+
+	// the shard the ring places the key on first, where the task most likely is
+	for i, database := range append([]string{placed}, shards.all()...) {
+		if i != 0 && database == placed {
+			continue
+		}
+
+		if id, err = idempotentTask(r, database, idempotencyKey); err != nil || len(id) != 0 {
+			return database, id, err
+		}
+	}
+
+	return placed, "", nil
+}
+
+// idempotentTask : the ID of the task a previous request with idempotencyKey created on database, empty if there is none
+func idempotentTask(r *http.Request, database, idempotencyKey string) (string, error) {
+	if len(idempotencyKey) == 0 {
+		return "", nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+database+scoped(r, "/getByIdempotencyKey"), nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	request.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer response.Body.Close()
+	id, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return string(id), nil
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", errors.New("Error: " + "unexpected response from the taskStore => " + response.Status)
+	}
+}
+
+// specParameter : the spec parameter, validated against the overlay images of owner and encoded again, nil without one
+func specParameter(values url.Values, owner string) ([]byte, error) {
+	raw := values.Get("spec")
+
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	spec, err := validSpec([]byte(raw), owner)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(spec)
+}
+
+// validSpec : the spec in raw, once validated against the operations and the overlay images of owner
+func validSpec(raw []byte, owner string) (task.Spec, error) {
+	spec, err := task.ParseSpec(raw)
+
+	if err != nil {
+		return spec, errors.New("invalid spec: " + err.Error())
+	}
+
+	if err = imageProcessing.ValidateSpec(spec); err != nil {
+		return spec, errors.New("invalid spec: " + err.Error())
+	}
+
+	if err = checkOverlays(owner, spec.Operations); err != nil {
+		return spec, errors.New("invalid spec: " + err.Error())
+	}
+
+	return spec, nil
+}
+
 func getImage(w http.ResponseWriter, r *http.Request) {
 	log.Println("getImage")
 
@@ -112,19 +349,41 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 
 	id := values.Get("id")
 
-	if len(id) == 0 {
-		errorHandling.RespondWithError(w, "invalid ID")
+	if err = task.ValidateID(id); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// the result by default, or the original, or another image made by the task such as a thumbnail
+	variant := values.Get("variant")
+
+	if len(variant) == 0 {
+		variant = task.VariantResult
+	}
+
+	if err = task.ValidateVariant(variant); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// the task tells in which tenant's images to look, and whether the caller may see it
+	requestedTask, err := getTask(r, id)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	response, err := http.Get("http://" + storageLocation + "/getImage?id=" + id + "&state=finished")
+	image, contentType, err := getFromStorage(id, requestedTask.Tenant, variant)
 
 	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	_, err = io.Copy(w, response.Body)
+	defer image.Close()
+	w.Header().Set("Content-Type", contentType)
+	_, err = io.Copy(w, image)
 
 	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
@@ -132,27 +391,28 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func isReady(w http.ResponseWriter, r *http.Request) {
+// listImages : the images stored for a task, as task.Variant
+func listImages(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		errorHandling.RespondOnlyXAccepted(w, "GET")
 		return
 	}
 
-	values, err := url.ParseQuery(r.URL.RawQuery)
+	id, err := idParameter(r)
 
 	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	id := values.Get("id")
+	requestedTask, err := getTask(r, id)
 
-	if len(id) == 0 {
-		errorHandling.RespondWithError(w, "invalid ID")
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	response, err := http.Get("http://" + databaseLocation + "/getById?" + id)
+	response, err := http.Get("http://" + storageLocation + "/listImages?id=" + id + "&tenant=" + requestedTask.Tenant)
 
 	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
@@ -167,76 +427,110 @@ func isReady(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	requestedTask := task.Task{}
-
-	json.Unmarshal(data, &requestedTask)
-
-	if requestedTask.State == task.StatusFinished {
-		fmt.Fprint(w, task.StatusFinished)
+	if response.StatusCode != http.StatusOK {
+		errorHandling.RespondWithError(w, string(data))
 		return
 	}
 
-	fmt.Fprint(w, task.StatusInProgress)
+	fmt.Fprint(w, string(data))
 }
 
-func getNewTask(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorHandling.RespondOnlyXAccepted(w, "POST")
+func isReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
 		return
 	}
 
-	response, err := http.Post("http://"+databaseLocation+"/getNewTask", "text/plain", nil)
+	values, err := url.ParseQuery(r.URL.RawQuery)
 
 	if err != nil {
-		fmt.Println("master :193", err.Error())
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	_, err = io.Copy(w, response.Body)
+	id := values.Get("id")
+
+	if err = task.ValidateID(id); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	requestedTask, err := getTask(r, id)
 
 	if err != nil {
-		fmt.Println("master :201", err.Error())
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
-}
 
-func registerTaskFinished(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("registerTaskFinished")
+	if requestedTask.IsDone() {
+		fmt.Fprint(w, requestedTask.State)
+		return
+	}
+
+	fmt.Fprint(w, task.StatusInProgress)
+}
 
+func getNewTask(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		errorHandling.RespondOnlyXAccepted(w, "POST")
 		return
 	}
 
-	values, err := url.ParseQuery(r.URL.RawQuery)
+	// every shard is asked in turn, starting with a different one each time,
+	// so that no shard's queue starves
+	for _, database := range shards.all() {
+		// forwards the worker's name
+		response, err := http.Post("http://"+database+"/getNewTask?"+r.URL.RawQuery, "text/plain", nil)
+
+		if err != nil {
+			fmt.Println("master :193", err.Error())
+			continue
+		}
+
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			continue
+		}
+
+		_, err = io.Copy(w, response.Body)
+		response.Body.Close()
+
+		if err != nil {
+			fmt.Println("master :201", err.Error())
+		}
 
-	if err != nil {
-		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	id := values.Get("id")
+	errorHandling.RespondWithError(w, "no available task")
+}
+
+// registerTaskFinished : marks the task done, storing what the worker found out about its input, sent as task.ImageInfo
+func registerTaskFinished(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("registerTaskFinished")
 
-	if len(id) == 0 {
-		errorHandling.RespondWithError(w, "invalid ID")
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
 		return
 	}
 
-	fmt.Println("Registering in database:", "http://"+databaseLocation+"/finishTask?id="+id)
-
-	response, err := http.Post("http://"+databaseLocation+"/finishTask?id="+id, "text/plain", nil)
+	values, err := url.ParseQuery(r.URL.RawQuery)
 
 	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	_, err = io.Copy(w, response.Body)
+	id := values.Get("id")
 
-	if err != nil {
+	if err = task.ValidateID(id); err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
+
+	fmt.Println("Registering in database:", "/finishTask?id="+id)
+
+	if proxyToShardOf(w, id, http.MethodPost, "/finishTask?id="+id, http.MaxBytesReader(w, r.Body, maxImageInfoSize)) == http.StatusOK {
+		go notifyTaskDone(id)
+	}
 }
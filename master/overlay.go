@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/imageProcessing"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// overlayName : the name parameter, checked before reaching the storage
+func overlayName(r *http.Request) (string, error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		return "", err
+	}
+
+	name := values.Get("name")
+
+	return name, task.ValidateOverlay(name)
+}
+
+// storedOverlays : the overlay images of owner
+func storedOverlays(owner string) ([]task.Variant, error) {
+	response, err := http.Get("http://" + storageLocation + "/listOverlays?tenant=" + owner)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("Error: " + "unexpected response from the storage => " + string(data))
+	}
+
+	overlays := []task.Variant{}
+	err = json.Unmarshal(data, &overlays)
+
+	return overlays, err
+}
+
+// checkOverlays : checks that owner has every overlay image the steps use, so that its task doesn't fail later
+func checkOverlays(owner string, steps []task.Operation) error {
+	names := imageProcessing.OverlaysOf(steps)
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	overlays, err := storedOverlays(owner)
+
+	if err != nil {
+		return err
+	}
+
+	stored := make(map[string]bool)
+
+	for _, overlay := range overlays {
+		stored[overlay.Name] = true
+	}
+
+	for _, name := range names {
+		if !stored[name] {
+			return errors.New("no overlay " + name + ", upload it to /newOverlay first")
+		}
+	}
+
+	return nil
+}
+
+// newOverlay : stores the uploaded image as an overlay of the caller, replacing the one with the same name
+func newOverlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	name, err := overlayName(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	image, contentType, ok := readUpload(w, r.Body)
+
+	if !ok || !withinQuota(w, r, 0) {
+		return
+	}
+
+	response, err := http.Post("http://"+storageLocation+"/sendOverlay?name="+name+"&tenant="+callerOf(r).ID, contentType, bytes.NewReader(image))
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		errorHandling.RespondWithError(w, "Error: unexpected response from the storage => "+response.Status)
+		return
+	}
+
+	fmt.Fprint(w, name)
+}
+
+// listOverlays : the overlay images of the caller, as task.Variant
+func listOverlays(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	overlays, err := storedOverlays(callerOf(r).ID)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	response, err := json.Marshal(overlays)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+// deleteOverlay : removes an overlay image of the caller, the tasks already created with it will fail
+func deleteOverlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		errorHandling.RespondOnlyXAccepted(w, "DELETE")
+		return
+	}
+
+	name, err := overlayName(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	request, err := http.NewRequest(http.MethodDelete, "http://"+storageLocation+"/deleteOverlay?name="+name+"&tenant="+callerOf(r).ID, nil)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		errorHandling.RespondWithError(w, "Error: unexpected response from the storage => "+response.Status)
+		return
+	}
+
+	fmt.Fprint(w, "Success")
+}
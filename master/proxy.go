@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+/*
+proxyTo :
+Forwards the response of the taskStore at address, status code included, and returns that status code.
+body is sent along with the request, nil for none
+*/
+func proxyTo(w http.ResponseWriter, address, method, path string, body io.Reader) int {
+	request, err := http.NewRequest(method, "http://"+address+path, body)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return http.StatusBadRequest
+	}
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return http.StatusBadRequest
+	}
+
+	defer response.Body.Close()
+	w.WriteHeader(response.StatusCode)
+
+	_, err = io.Copy(w, response.Body)
+
+	if err != nil {
+		fmt.Println("Error copying the taskStore response:", err.Error())
+	}
+
+	return response.StatusCode
+}
+
+// proxyToShardOf : proxyTo the shard owning the task, batch or workflow id
+func proxyToShardOf(w http.ResponseWriter, id, method, path string, body io.Reader) int {
+	database, err := shards.forID(id)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return http.StatusBadRequest
+	}
+
+	return proxyTo(w, database, method, path, body)
+}
+
+// getFromEveryShard : the body each shard responded with to a GET on path
+func getFromEveryShard(path string) ([][]byte, error) {
+	bodies := [][]byte{}
+
+	for _, database := range shards.all() {
+		response, err := http.Get("http://" + database + path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if response.StatusCode != http.StatusOK {
+			return nil, errors.New(string(data))
+		}
+
+		bodies = append(bodies, data)
+	}
+
+	return bodies, nil
+}
+
+// getTask : the task id, if the caller may see it
+func getTask(r *http.Request, id string) (task.Task, error) {
+	t := task.Task{}
+	database, err := shards.forID(id)
+
+	if err != nil {
+		return t, err
+	}
+
+	response, err := http.Get("http://" + database + scoped(r, "/getByID?id="+id))
+
+	if err != nil {
+		return t, err
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return t, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return t, errors.New(string(data))
+	}
+
+	err = json.Unmarshal(data, &t)
+
+	return t, err
+}
+
+func idParameter(r *http.Request) (string, error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		return "", err
+	}
+
+	id := values.Get("id")
+
+	return id, task.ValidateID(id)
+}
+
+// gcReport : what the next collection of done tasks of each shard would remove
+func gcReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	bodies, err := getFromEveryShard("/gcReport")
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	reports := []json.RawMessage{}
+
+	for _, body := range bodies {
+		reports = append(reports, json.RawMessage(body))
+	}
+
+	response, err := json.Marshal(reports)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+/*
+listTasks :
+The task listing of every shard merged into one, see task.ParseListQuery for the parameters.
+Cursors hold the sort key of the last task, so the same cursor pages through every shard
+*/
+func listTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	query, err := task.ParseListQuery(values)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// tenants only list their own tasks
+	bodies, err := getFromEveryShard(scoped(r, "/list?"+r.URL.RawQuery))
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	merged := task.Listing{
+		Tasks:  []task.Task{},
+		Counts: make(map[int]int),
+	}
+	hasMore := false
+
+	for _, body := range bodies {
+		listing := task.Listing{}
+
+		if err = json.Unmarshal(body, &listing); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+
+		merged.Tasks = append(merged.Tasks, listing.Tasks...)
+		merged.Total += listing.Total
+		hasMore = hasMore || len(listing.NextCursor) != 0
+
+		for state, count := range listing.Counts {
+			merged.Counts[state] += count
+		}
+	}
+
+	sort.SliceStable(merged.Tasks, func(i, j int) bool {
+		return query.Less(merged.Tasks[i], merged.Tasks[j])
+	})
+
+	if len(merged.Tasks) > query.Limit {
+		merged.Tasks = merged.Tasks[:query.Limit]
+		hasMore = true
+	}
+
+	if hasMore && len(merged.Tasks) != 0 {
+		merged.NextCursor = query.CursorOf(merged.Tasks[len(merged.Tasks)-1]).Encode()
+	}
+
+	response, err := json.Marshal(merged)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
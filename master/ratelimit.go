@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+// RateLimit : a token bucket refilled with Rate tokens per second, holding at most Burst tokens
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+/*
+RateLimits :
+Read from the JSON file at MASTER_RATE_LIMITS_FILE:
+
+	{"default": {"rate": 10, "burst": 20}, "routes": {"/newImage": {"rate": 1, "burst": 5}}}
+
+Routes without a limit of their own use the default one, a zero rate means no limit.
+The paths that aren't routes of the master share one bucket per client, with the default limit
+*/
+type RateLimits struct {
+	Default RateLimit            `json:"default"`
+	Routes  map[string]RateLimit `json:"routes"`
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	path     string
+	modified time.Time
+	limits   RateLimits
+	// one bucket per route and client, and per client for the unknown paths
+	buckets map[string]*bucket
+	mutex   sync.Mutex
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*bucket)}
+
+// forRoute : the limit of route, ok is false if it isn't limited
+func (limits RateLimits) forRoute(route string) (limit RateLimit, ok bool) {
+	limit, exists := limits.Routes[route]
+
+	if !exists {
+		limit = limits.Default
+	}
+
+	return limit, limit.Rate > 0 && limit.Burst > 0
+}
+
+/*
+watchRateLimits :
+Loads the limits, then reloads them every interval if the file changed,
+keeping the previous limits if the new ones are invalid
+*/
+func watchRateLimits(path string, interval time.Duration) error {
+	limiter.path = path
+
+	if len(path) == 0 {
+		return nil
+	}
+
+	if err := limiter.reload(); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			if err := limiter.reload(); err != nil {
+				fmt.Println("Error: ", "can't reload the rate limits", err.Error())
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			limiter.forgetIdleBuckets()
+		}
+	}()
+
+	return nil
+}
+
+func (limiter *rateLimiter) reload() error {
+	info, err := os.Stat(limiter.path)
+
+	if err != nil {
+		return err
+	}
+
+	limiter.mutex.Lock()
+	unchanged := info.ModTime().Equal(limiter.modified)
+	limiter.mutex.Unlock()
+
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(limiter.path)
+
+	if err != nil {
+		return err
+	}
+
+	limits := RateLimits{}
+
+	if err = json.Unmarshal(data, &limits); err != nil {
+		return err
+	}
+
+	limiter.mutex.Lock()
+	limiter.limits = limits
+	limiter.modified = info.ModTime()
+	limiter.mutex.Unlock()
+
+	fmt.Println("Rate limits loaded from", limiter.path)
+
+	return nil
+}
+
+// forgetIdleBuckets : a bucket unused for an hour is full again, the same as no bucket
+func (limiter *rateLimiter) forgetIdleBuckets() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+
+	for key, b := range limiter.buckets {
+		if now.Sub(b.last) > time.Hour {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+/*
+take :
+Takes a token from the bucket of key, refilled since it was last used.
+Returns the tokens left, and how long to wait for the next token when none was left
+*/
+func (limiter *rateLimiter) take(key string, limit RateLimit) (remaining float64, wait time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	b, exists := limiter.buckets[key]
+
+	if !exists {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		limiter.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return b.tokens, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+
+	b.tokens--
+
+	return b.tokens, 0
+}
+
+// clientOf : the API key of the request if it is a valid one, its IP address otherwise
+func clientOf(r *http.Request) string {
+	apiKey := r.Header.Get(tenant.APIKeyHeader)
+
+	// unknown keys would give a new bucket to every made up key,
+	// and without tenants every key is accepted
+	if _, err := tenants.Authenticate(apiKey); err == nil && len(apiKey) != 0 && tenants.Enabled() {
+		return "key:" + apiKey
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+/*
+rateLimited :
+Refuses requests over the limit of their route with a 429 and a Retry-After header.
+Limited responses carry X-RateLimit-Limit (the burst), X-RateLimit-Remaining,
+and X-RateLimit-Reset (seconds until the bucket is full again)
+*/
+func rateLimited(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the pattern of the route, empty for every path the mux doesn't know,
+		// so made up paths can't each get a full bucket
+		_, route := mux.Handler(r)
+
+		limiter.mutex.Lock()
+		limit, ok := limiter.limits.forRoute(route)
+		limiter.mutex.Unlock()
+
+		if !ok {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		remaining, wait := limiter.take(route+"|"+clientOf(r), limit)
+		reset := math.Ceil((float64(limit.Burst) - remaining) / limit.Rate)
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(reset)))
+
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			errorHandling.RespondWithStatus(w, http.StatusTooManyRequests, "rate limit exceeded on "+r.URL.Path)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
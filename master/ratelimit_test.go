@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+// useLimiter : a limiter with empty buckets, and the tenants of the JSON file at path, none without one
+func useLimiter(t *testing.T, limits RateLimits, path string) {
+	previous, previousTenants := limiter, tenants
+	t.Cleanup(func() { limiter, tenants = previous, previousTenants })
+
+	limiter = &rateLimiter{buckets: make(map[string]*bucket), limits: limits}
+
+	var err error
+
+	if tenants, err = tenant.Load(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRateLimitedRoutes : buckets belong to the routes of the mux, every other path shares one
+func TestRateLimitedRoutes(t *testing.T) {
+	useLimiter(t, RateLimits{
+		Default: RateLimit{Rate: 0.001, Burst: 1},
+		Routes:  map[string]RateLimit{"/unlimited": {}},
+	}, "")
+
+	mux := http.NewServeMux()
+
+	for _, route := range []string{"/first", "/second", "/unlimited"} {
+		mux.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {})
+	}
+
+	handler := rateLimited(mux)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/first", http.StatusOK},
+		{"/first?query=other", http.StatusTooManyRequests},
+		{"/second", http.StatusOK},
+		{"/unlimited", http.StatusOK},
+		{"/unlimited", http.StatusOK},
+		// a 404, then the bucket of the unknown paths is empty
+		{"/unknown", http.StatusNotFound},
+		{"/madeUp", http.StatusTooManyRequests},
+		{"/first/", http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		if w.Code != test.status {
+			t.Errorf("%s: %d, expected %d", test.path, w.Code, test.status)
+		}
+	}
+}
+
+// TestRateLimitedClients : only the keys of the tenants, and the service key, get buckets of their own
+func TestRateLimitedClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	registry := `{"serviceKey": "serviceKey", "tenants": [{"id": "acme", "apiKey": "acmeKey"}, {"id": "globex", "apiKey": "globexKey"}]}`
+
+	if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tenants string
+		// the keys sent in turn from the same address, and whether each request is limited
+		keys    []string
+		limited []bool
+	}{
+		{
+			name:    "made up keys without tenants",
+			keys:    []string{"", "first", "second", "third"},
+			limited: []bool{false, true, true, true},
+		},
+		{
+			name:    "made up keys with tenants",
+			tenants: path,
+			keys:    []string{"first", "second", ""},
+			limited: []bool{false, true, true},
+		},
+		{
+			name:    "keys of tenants",
+			tenants: path,
+			keys:    []string{"acmeKey", "globexKey", "serviceKey", "", "acmeKey", "madeUp"},
+			limited: []bool{false, false, false, false, true, true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useLimiter(t, RateLimits{Default: RateLimit{Rate: 0.001, Burst: 1}}, test.tenants)
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/route", func(w http.ResponseWriter, r *http.Request) {})
+			handler := rateLimited(mux)
+
+			for i, key := range test.keys {
+				r := httptest.NewRequest(http.MethodGet, "/route", nil)
+				r.Header.Set(tenant.APIKeyHeader, key)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if limited := w.Code == http.StatusTooManyRequests; limited != test.limited[i] {
+					t.Errorf("request %d with the key %q: %d", i, key, w.Code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/dataAccess"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+const (
+	shardKeyPrefix = "databaseShard."
+	// points of each shard on the ring, to spread keys evenly with few shards
+	virtualNodes = 64
+)
+
+var shards = &shardRing{}
+
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+/*
+shardRing :
+The taskStore shards registered in the key-value store.
+New tasks are placed on a shard by consistent hashing of a key,
+existing ones are found through the shard number stored in their ID
+*/
+type shardRing struct {
+	addresses map[int]string
+	points    []ringPoint
+	mutex     sync.RWMutex
+	// rotates the shard asked first for a new task
+	nextShard uint32
+}
+
+// hashKey : short keys like "k1" and "k2" need a hash that spreads them over the whole ring
+func hashKey(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// watchShards : loads the shards, then reloads them every interval
+func watchShards(keyValueStoreAddress string, interval time.Duration) error {
+	if err := shards.refresh(keyValueStoreAddress); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			if err := shards.refresh(keyValueStoreAddress); err != nil {
+				fmt.Println("Error: ", "can't refresh the taskStore shards", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (ring *shardRing) refresh(keyValueStoreAddress string) error {
+	registered, err := dataAccess.ListValues(keyValueStoreAddress, shardKeyPrefix)
+
+	if err != nil {
+		return err
+	}
+
+	addresses := make(map[int]string)
+
+	for key, address := range registered {
+		shard, err := strconv.Atoi(strings.TrimPrefix(key, shardKeyPrefix))
+
+		if err != nil || shard < 0 || shard >= task.MaxShards {
+			fmt.Println("Error: ", "ignoring invalid shard key", key)
+			continue
+		}
+
+		addresses[shard] = address
+	}
+
+	// a taskStore that predates sharding only registers databaseAddress
+	if len(addresses) == 0 {
+		address, err := dataAccess.GetValue(keyValueStoreAddress, "databaseAddress")
+
+		if err != nil {
+			return err
+		}
+
+		if len(address) == 0 {
+			return errors.New("Error: no taskStore registered")
+		}
+
+		addresses[0] = address
+	}
+
+	ring.set(addresses)
+
+	return nil
+}
+
+// set : places the shards at addresses, by shard number, on the ring
+func (ring *shardRing) set(addresses map[int]string) {
+	points := make([]ringPoint, 0, len(addresses)*virtualNodes)
+
+	for shard := range addresses {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, ringPoint{
+				hash:  hashKey(strconv.Itoa(shard) + "#" + strconv.Itoa(i)),
+				shard: shard,
+			})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	ring.mutex.Lock()
+	ring.addresses = addresses
+	ring.points = points
+	ring.mutex.Unlock()
+}
+
+// forKey : the address of the shard that creates the tasks for key
+func (ring *shardRing) forKey(key string) (string, error) {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+
+	if len(ring.points) == 0 {
+		return "", errors.New("Error: no taskStore shard available")
+	}
+
+	hash := hashKey(key)
+	i := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= hash
+	})
+
+	if i == len(ring.points) {
+		i = 0
+	}
+
+	return ring.addresses[ring.points[i].shard], nil
+}
+
+// forID : the address of the shard owning the task, batch or workflow id
+func (ring *shardRing) forID(id string) (string, error) {
+	if err := task.ValidateID(id); err != nil {
+		return "", err
+	}
+
+	ring.mutex.RLock()
+	address, exists := ring.addresses[task.ShardOf(id)]
+	ring.mutex.RUnlock()
+
+	if !exists {
+		return "", errors.New("Error: the shard of " + id + " isn't available")
+	}
+
+	return address, nil
+}
+
+// all : the address of every shard, starting at a different shard on each call
+func (ring *shardRing) all() []string {
+	ring.mutex.RLock()
+	numbers := make([]int, 0, len(ring.addresses))
+
+	for shard := range ring.addresses {
+		numbers = append(numbers, shard)
+	}
+
+	sort.Ints(numbers)
+
+	addresses := make([]string, len(numbers))
+	start := int(atomic.AddUint32(&ring.nextShard, 1))
+
+	for i := range numbers {
+		addresses[i] = ring.addresses[numbers[(start+i)%len(numbers)]]
+	}
+	ring.mutex.RUnlock()
+
+	return addresses
+}
+
+// shardKey : the key placing a new task on a shard, retries with the same idempotency key land on the same shard
+func shardKey(idempotencyKey string) string {
+	if len(idempotencyKey) != 0 {
+		return idempotencyKey
+	}
+
+	random := make([]byte, 16)
+	rand.Read(random)
+
+	return hex.EncodeToString(random)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// TestNewImageOperations : a spec of too many operations is refused before any task is created
+func TestNewImageOperations(t *testing.T) {
+	tests := []struct {
+		name       string
+		operations int
+		valid      bool
+	}{
+		{name: "up to the limit", operations: 32, valid: true},
+		{name: "over the limit", operations: 33},
+		{name: "far over the limit", operations: 5000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := task.Spec{Operations: make([]task.Operation, test.operations)}
+
+			for i := range spec.Operations {
+				spec.Operations[i] = task.Operation{Name: "resize", Params: map[string]interface{}{"width": 10000.0}}
+			}
+
+			raw, err := json.Marshal(spec)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = validSpec(raw, "")
+
+			if valid := err == nil; valid != test.valid {
+				t.Fatalf("valid %v, expected %v: %v", valid, test.valid, err)
+			}
+
+			if test.valid {
+				return
+			}
+
+			// refused before the upload is even read
+			w := httptest.NewRecorder()
+			newImage(w, httptest.NewRequest(http.MethodPost, "/newImage?spec="+url.QueryEscape(string(raw)), nil))
+
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "operations") {
+				t.Fatalf("%d: %s, expected a 400", w.Code, w.Body.String())
+			}
+		})
+	}
+}
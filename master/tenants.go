@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+type contextKey int
+
+const callerKey contextKey = 0
+
+var tenants *tenant.Registry
+
+// forTenants : authenticates the X-API-Key header, the handler gets the caller with callerOf
+func forTenants(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := tenants.Authenticate(r.Header.Get(tenant.APIKeyHeader))
+
+		if err != nil {
+			errorHandling.RespondWithStatus(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), callerKey, caller)))
+	}
+}
+
+// forServices : endpoints of the workers and operators, which need the service key when there are tenants
+func forServices(handler http.HandlerFunc) http.HandlerFunc {
+	return forTenants(func(w http.ResponseWriter, r *http.Request) {
+		if len(callerOf(r).ID) != 0 {
+			errorHandling.RespondWithStatus(w, http.StatusForbidden, "only workers and operators can use this endpoint")
+			return
+		}
+
+		handler(w, r)
+	})
+}
+
+// callerOf : the tenant making the request, the zero Tenant for workers and operators
+func callerOf(r *http.Request) tenant.Tenant {
+	caller, _ := r.Context().Value(callerKey).(tenant.Tenant)
+
+	return caller
+}
+
+/*
+scoped :
+Adds the tenant of the caller to the query of path, so that the taskStore and the
+fileStorage only show its tasks and images, and stamp the ones it creates
+*/
+func scoped(r *http.Request, path string) string {
+	owner := callerOf(r).ID
+
+	if len(owner) == 0 {
+		return path
+	}
+
+	parsed, err := url.Parse(path)
+
+	if err != nil {
+		return path
+	}
+
+	values := parsed.Query()
+	values.Set("tenant", owner)
+	parsed.RawQuery = values.Encode()
+
+	return parsed.String()
+}
+
+// queuedTasks : the tasks of owner not started yet, on every shard
+func queuedTasks(owner string) (int, error) {
+	bodies, err := getFromEveryShard("/list?state=" + strconv.Itoa(task.StatusNotStarted) + "&limit=1&tenant=" + owner)
+
+	if err != nil {
+		return 0, err
+	}
+
+	queued := 0
+
+	for _, body := range bodies {
+		listing := task.Listing{}
+
+		if err = json.Unmarshal(body, &listing); err != nil {
+			return 0, err
+		}
+
+		queued += listing.Total
+	}
+
+	return queued, nil
+}
+
+// storedBytes : the bytes of the images of owner in the fileStorage
+func storedBytes(owner string) (int64, error) {
+	response, err := http.Get("http://" + storageLocation + "/usage?tenant=" + owner)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return 0, errors.New("Error: " + "unexpected response from the storage => " + string(data))
+	}
+
+	sizes := make(map[string]int64)
+
+	if err = json.Unmarshal(data, &sizes); err != nil {
+		return 0, err
+	}
+
+	var total int64
+
+	for _, size := range sizes {
+		total += size
+	}
+
+	return total, nil
+}
+
+/*
+withinQuota :
+Responds with a 429 and returns false when creating tasks more tasks,
+and storing the body of the request, would exceed a quota of the caller
+*/
+func withinQuota(w http.ResponseWriter, r *http.Request, tasks int) bool {
+	caller := callerOf(r)
+
+	if caller.MaxQueuedTasks > 0 {
+		queued, err := queuedTasks(caller.ID)
+
+		if err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return false
+		}
+
+		if queued+tasks > caller.MaxQueuedTasks {
+			errorHandling.RespondWithStatus(w, http.StatusTooManyRequests, fmt.Sprintf(
+				"quota exceeded: %d queued tasks, %d more would go over maxQueuedTasks (%d)",
+				queued, tasks, caller.MaxQueuedTasks))
+			return false
+		}
+	}
+
+	if caller.MaxStoredBytes > 0 {
+		stored, err := storedBytes(caller.ID)
+
+		if err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return false
+		}
+
+		// the size of a chunked upload isn't known in advance
+		incoming := r.ContentLength
+
+		if incoming < 0 {
+			incoming = 0
+		}
+
+		if stored+incoming > caller.MaxStoredBytes {
+			errorHandling.RespondWithStatus(w, http.StatusTooManyRequests, fmt.Sprintf(
+				"quota exceeded: %d bytes stored, %d more would go over maxStoredBytes (%d)",
+				stored, incoming, caller.MaxStoredBytes))
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/imageProcessing"
+)
+
+var uploadLimits imageProcessing.Limits
+
+/*
+checkUpload :
+Checks an uploaded image of size bytes before any task is created for it,
+responds with a 413 if it is too large, a 415 if it isn't a supported image
+*/
+func checkUpload(w http.ResponseWriter, image io.Reader, size int64) (contentType string, ok bool) {
+	contentType, err := uploadLimits.Check(image, size)
+
+	if _, tooLarge := err.(imageProcessing.LimitError); tooLarge {
+		errorHandling.RespondWithStatus(w, http.StatusRequestEntityTooLarge, err.Error())
+		return "", false
+	}
+
+	if err != nil {
+		errorHandling.RespondWithStatus(w, http.StatusUnsupportedMediaType, err.Error())
+		return "", false
+	}
+
+	return contentType, true
+}
+
+// readUpload : reads and checks an uploaded image, never reading more than the limit
+func readUpload(w http.ResponseWriter, body io.Reader) (data []byte, contentType string, ok bool) {
+	if uploadLimits.MaxBytes > 0 {
+		// one more byte tells whether the limit is exceeded
+		body = io.LimitReader(body, uploadLimits.MaxBytes+1)
+	}
+
+	data, err := ioutil.ReadAll(body)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return nil, "", false
+	}
+
+	// the rest of the body isn't read, its size is unknown
+	if uploadLimits.MaxBytes > 0 && int64(len(data)) > uploadLimits.MaxBytes {
+		errorHandling.RespondWithStatus(w, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"the image is over the limit of %d bytes", uploadLimits.MaxBytes))
+		return nil, "", false
+	}
+
+	contentType, ok = checkUpload(w, bytes.NewReader(data), int64(len(data)))
+
+	return data, contentType, ok
+}
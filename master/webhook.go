@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+const (
+	webhookIDHeader        = "X-Webhook-ID"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	// hex HMAC-SHA256 of timestamp + "." + body, keyed with MASTER_WEBHOOK_SECRET
+	webhookSignatureHeader = "X-Webhook-Signature"
+	maxLoggedDeliveries    = 1000
+)
+
+var webhooks *webhookSender
+
+// WebhookPayload : the JSON body posted to a task's callback URL
+type WebhookPayload struct {
+	TaskID string    `json:"taskId"`
+	State  int       `json:"state"`
+	Time   time.Time `json:"time"`
+}
+
+// WebhookAttempt : the outcome of one try to deliver a webhook
+type WebhookAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// WebhookDelivery : a webhook and every attempt made to deliver it
+type WebhookDelivery struct {
+	ID        int              `json:"id"`
+	TaskID    string           `json:"taskId"`
+	Tenant    string           `json:"tenant,omitempty"`
+	URL       string           `json:"url"`
+	Payload   WebhookPayload   `json:"payload"`
+	Attempts  []WebhookAttempt `json:"attempts"`
+	Delivered bool             `json:"delivered"`
+}
+
+type webhookSender struct {
+	secret      []byte
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+
+	// the last maxLoggedDeliveries deliveries, oldest first
+	deliveries     []*WebhookDelivery
+	lastDeliveryID int
+	mutex          sync.Mutex
+}
+
+/*
+newWebhookSender :
+Webhooks that fail (network error or non 2xx response) are retried up to
+maxAttempts times, waiting backoff, then twice as long after each failure
+*/
+func newWebhookSender(secret string, client *http.Client, maxAttempts int, backoff time.Duration) *webhookSender {
+	if len(secret) == 0 {
+		fmt.Println("Warning: ", "MASTER_WEBHOOK_SECRET isn't set, webhooks won't be signed")
+	}
+
+	return &webhookSender{
+		secret:      []byte(secret),
+		client:      client,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+}
+
+func validateCallback(callback string) error {
+	parsed, err := url.ParseRequestURI(callback)
+
+	if err != nil {
+		return err
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.New("the callback must be an http or https URL")
+	}
+
+	return nil
+}
+
+// sign : the signature receivers compare with the X-Webhook-Signature header
+func (sender *webhookSender) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, sender.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// send : delivers the payload, blocking until it succeeds or every attempt failed
+func (sender *webhookSender) send(callback, owner string, payload WebhookPayload) *WebhookDelivery {
+	delivery := sender.logDelivery(callback, owner, payload)
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		fmt.Println("Error: ", "webhook => json.Marshal", err.Error())
+		return delivery
+	}
+
+	wait := sender.backoff
+
+	for attempt := 1; attempt <= sender.maxAttempts; attempt++ {
+		result := sender.attempt(delivery.ID, callback, body)
+
+		sender.mutex.Lock()
+		delivery.Attempts = append(delivery.Attempts, result)
+		delivery.Delivered = len(result.Error) == 0
+		sender.mutex.Unlock()
+
+		if len(result.Error) == 0 {
+			fmt.Println("Webhook", delivery.ID, "delivered to", callback)
+			return delivery
+		}
+
+		fmt.Println("Error: ", "webhook", delivery.ID, "attempt", attempt, "failed:", result.Error)
+
+		if attempt < sender.maxAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+
+	return delivery
+}
+
+func (sender *webhookSender) attempt(id int, callback string, body []byte) WebhookAttempt {
+	result := WebhookAttempt{Time: time.Now()}
+	timestamp := strconv.FormatInt(result.Time.Unix(), 10)
+
+	request, err := http.NewRequest(http.MethodPost, callback, bytes.NewReader(body))
+
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookIDHeader, strconv.Itoa(id))
+	request.Header.Set(webhookTimestampHeader, timestamp)
+
+	if len(sender.secret) != 0 {
+		request.Header.Set(webhookSignatureHeader, "sha256="+sender.sign(timestamp, body))
+	}
+
+	response, err := sender.client.Do(request)
+
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+
+	result.StatusCode = response.StatusCode
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		result.Error = "unexpected response => " + response.Status
+	}
+
+	return result
+}
+
+func (sender *webhookSender) logDelivery(callback, owner string, payload WebhookPayload) *WebhookDelivery {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	sender.lastDeliveryID++
+	delivery := &WebhookDelivery{
+		ID:       sender.lastDeliveryID,
+		TaskID:   payload.TaskID,
+		Tenant:   owner,
+		URL:      callback,
+		Payload:  payload,
+		Attempts: []WebhookAttempt{},
+	}
+
+	if len(sender.deliveries) == maxLoggedDeliveries {
+		sender.deliveries = sender.deliveries[1:]
+	}
+	sender.deliveries = append(sender.deliveries, delivery)
+
+	return delivery
+}
+
+// list : a copy of the logged deliveries of owner, for every task if taskID is empty, and every tenant if owner is
+func (sender *webhookSender) list(taskID, owner string) []WebhookDelivery {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	deliveries := []WebhookDelivery{}
+
+	for _, delivery := range sender.deliveries {
+		if (len(taskID) == 0 || delivery.TaskID == taskID) && (len(owner) == 0 || delivery.Tenant == owner) {
+			copied := *delivery
+			copied.Attempts = append([]WebhookAttempt{}, delivery.Attempts...)
+			deliveries = append(deliveries, copied)
+		}
+	}
+
+	return deliveries
+}
+
+// notifyTaskDone : sends the webhook of the task id, if it has a callback
+func notifyTaskDone(id string) {
+	database, err := shards.forID(id)
+
+	if err != nil {
+		fmt.Println("Error: ", "notifyTaskDone => shards.forID", err.Error())
+		return
+	}
+
+	response, err := http.Get("http://" + database + "/getByID?id=" + id)
+
+	if err != nil {
+		fmt.Println("Error: ", "notifyTaskDone => http.Get", err.Error())
+		return
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil || response.StatusCode != http.StatusOK {
+		fmt.Println("Error: ", "notifyTaskDone => can't get task", id, string(data))
+		return
+	}
+
+	t := task.Task{}
+
+	if err = json.Unmarshal(data, &t); err != nil {
+		fmt.Println("Error: ", "notifyTaskDone => json.Unmarshal", err.Error())
+		return
+	}
+
+	if len(t.Callback) == 0 {
+		return
+	}
+
+	webhooks.send(t.Callback, t.Tenant, WebhookPayload{
+		TaskID: t.ID,
+		State:  t.State,
+		Time:   time.Now(),
+	})
+}
+
+// webhookDeliveries : the delivery log, optionally filtered by taskId
+func webhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	taskID := values.Get("taskId")
+
+	if len(taskID) != 0 {
+		if err = task.ValidateID(taskID); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+	}
+
+	response, err := json.Marshal(webhooks.list(taskID, callerOf(r).ID))
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
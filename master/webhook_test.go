@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// testReceiver : a webhook receiver failing its first requests with a 500, and keeping every request
+type testReceiver struct {
+	server   *httptest.Server
+	failures int
+	requests []receivedWebhook
+	mutex    sync.Mutex
+}
+
+type receivedWebhook struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+}
+
+func newTestReceiver(t *testing.T, failures int) *testReceiver {
+	receiver := &testReceiver{failures: failures}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		receiver.requests = append(receiver.requests, receivedWebhook{at: time.Now(), header: r.Header.Clone(), body: body})
+
+		if len(receiver.requests) <= receiver.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(receiver.server.Close)
+
+	return receiver
+}
+
+func (receiver *testReceiver) received() []receivedWebhook {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	return append([]receivedWebhook{}, receiver.requests...)
+}
+
+// testSignature : the signature of a webhook, computed as receivers are told to
+func testSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookSend(t *testing.T) {
+	const backoff = 20 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		failures  int
+		attempts  int
+		delivered bool
+	}{
+		{name: "delivered at once", failures: 0, attempts: 1, delivered: true},
+		{name: "delivered after failures", failures: 2, attempts: 3, delivered: true},
+		{name: "every attempt failed", failures: 10, attempts: 4, delivered: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver := newTestReceiver(t, test.failures)
+			sender := newWebhookSender("secret", receiver.server.Client(), 4, backoff)
+			payload := WebhookPayload{TaskID: "01HF8Z4Q7E0G3XK9V2M6TBN4RD", State: task.StatusFinished, Time: time.Now().UTC()}
+
+			delivery := sender.send(receiver.server.URL+"/hook", "acme", payload)
+			requests := receiver.received()
+
+			if len(requests) != test.attempts {
+				t.Fatalf("%d attempts, expected %d", len(requests), test.attempts)
+			}
+
+			for i, request := range requests {
+				timestamp := request.header.Get(webhookTimestampHeader)
+
+				if signature := request.header.Get(webhookSignatureHeader); signature != testSignature("secret", timestamp, request.body) {
+					t.Errorf("attempt %d: signature %q of %s.%s", i, signature, timestamp, request.body)
+				}
+
+				if id := request.header.Get(webhookIDHeader); id != "1" {
+					t.Errorf("attempt %d: id %q, expected 1", i, id)
+				}
+
+				received := WebhookPayload{}
+
+				if err := json.Unmarshal(request.body, &received); err != nil || received.TaskID != payload.TaskID || received.State != payload.State || !received.Time.Equal(payload.Time) {
+					t.Errorf("attempt %d: payload %s, expected %+v", i, request.body, payload)
+				}
+
+				// backoff, then twice as long after each failure
+				if i > 0 {
+					expected := backoff << (i - 1)
+
+					if waited := request.at.Sub(requests[i-1].at); waited < expected || waited > expected+time.Second {
+						t.Errorf("attempt %d after %s, expected %s", i, waited, expected)
+					}
+				}
+			}
+
+			if delivery.Delivered != test.delivered || len(delivery.Attempts) != test.attempts {
+				t.Fatalf("delivered %v after %d attempts, expected %v after %d", delivery.Delivered, len(delivery.Attempts), test.delivered, test.attempts)
+			}
+
+			logged := sender.list(payload.TaskID, "acme")
+
+			if len(logged) != 1 || logged[0].ID != 1 || logged[0].URL != receiver.server.URL+"/hook" || logged[0].Tenant != "acme" || logged[0].Delivered != test.delivered {
+				t.Fatalf("unexpected delivery log %+v", logged)
+			}
+
+			for i, attempt := range logged[0].Attempts {
+				failed := i < test.failures
+
+				if failed != (attempt.StatusCode == http.StatusInternalServerError) || failed != (len(attempt.Error) != 0) {
+					t.Errorf("attempt %d logged as %+v", i, attempt)
+				}
+			}
+
+			if others := sender.list("", "other"); len(others) != 0 {
+				t.Errorf("the deliveries of acme are listed for another tenant: %+v", others)
+			}
+		})
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	receiver := newTestReceiver(t, 0)
+	sender := newWebhookSender("", receiver.server.Client(), 1, time.Millisecond)
+	sender.send(receiver.server.URL, "", WebhookPayload{TaskID: "01HF8Z4Q7E0G3XK9V2M6TBN4RD"})
+
+	if requests := receiver.received(); len(requests) != 1 || len(requests[0].header.Get(webhookSignatureHeader)) != 0 {
+		t.Fatalf("expected a single unsigned webhook, got %d", len(requests))
+	}
+}
+
+func TestWebhookUnreachable(t *testing.T) {
+	receiver := newTestReceiver(t, 0)
+	receiver.server.Close()
+	sender := newWebhookSender("secret", receiver.server.Client(), 2, time.Millisecond)
+
+	delivery := sender.send(receiver.server.URL, "", WebhookPayload{TaskID: "01HF8Z4Q7E0G3XK9V2M6TBN4RD"})
+
+	if delivery.Delivered || len(delivery.Attempts) != 2 || len(delivery.Attempts[1].Error) == 0 || delivery.Attempts[1].StatusCode != 0 {
+		t.Fatalf("unexpected delivery %+v", delivery)
+	}
+}
+
+// TestNotifyTaskDone : the webhook of a task is sent to the callback the taskStore shard has for it
+func TestNotifyTaskDone(t *testing.T) {
+	receiver := newTestReceiver(t, 1)
+	id := task.NewIDGenerator(0).New()
+	shard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/getByID" || r.URL.Query().Get("id") != id {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(task.Task{ID: id, State: task.StatusFailed, Tenant: "acme", Callback: receiver.server.URL})
+	}))
+	defer shard.Close()
+
+	shards.set(map[int]string{0: strings.TrimPrefix(shard.URL, "http://")})
+	defer shards.set(map[int]string{})
+
+	previous := webhooks
+	webhooks = newWebhookSender("secret", receiver.server.Client(), 3, time.Millisecond)
+	defer func() { webhooks = previous }()
+
+	notifyTaskDone(id)
+
+	deliveries := webhooks.list(id, "acme")
+
+	if len(deliveries) != 1 || !deliveries[0].Delivered || len(deliveries[0].Attempts) != 2 || deliveries[0].Payload.State != task.StatusFailed {
+		t.Fatalf("unexpected deliveries %+v", deliveries)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+/*
+newWorkflow :
+Expects a multipart form with a "workflow" field (JSON, see task.WorkflowRequest)
+and an "image" file, used as the input of every task that doesn't depend on another one.
+The spec of each step is validated as the spec of newImage
+*/
+func newWorkflow(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("newWorkflow")
+
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	if err := r.ParseMultipartForm(10000000); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	request := task.WorkflowRequest{}
+	// unknown fields are rejected, as in a spec
+	decoder := json.NewDecoder(strings.NewReader(r.FormValue("workflow")))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&request); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	for i, step := range request.Tasks {
+		if step.Spec == nil {
+			continue
+		}
+
+		raw, err := json.Marshal(step.Spec)
+
+		if err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+
+		spec, err := validSpec(raw, callerOf(r).ID)
+
+		if err != nil {
+			errorHandling.RespondWithError(w, "step "+step.Name+": "+err.Error())
+			return
+		}
+
+		request.Tasks[i].Spec = &spec
+	}
+
+	workflow, err := json.Marshal(request)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	defer file.Close()
+	img, contentType, ok := readUpload(w, file)
+
+	if !ok || !admitted(w, r, len(request.Tasks)) || !withinQuota(w, r, len(request.Tasks)) {
+		return
+	}
+
+	// every task of a workflow is on the same shard, which checks their dependencies
+	database, err := shards.forKey(shardKey(r.Header.Get(idempotencyKeyHeader)))
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	response, err := http.Post("http://"+database+scoped(r, "/newWorkflow"), "application/json", bytes.NewReader(workflow))
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		errorHandling.RespondWithError(w, string(data))
+		return
+	}
+
+	created := task.WorkflowCreated{}
+
+	if err = json.Unmarshal(data, &created); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	for _, step := range request.Tasks {
+		if len(step.DependsOn) != 0 {
+			continue
+		}
+
+		if err = sendToStorage(created.Tasks[step.Name], callerOf(r).ID, contentType, bytes.NewReader(img)); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+	}
+
+	fmt.Fprint(w, string(data))
+}
+
+func getWorkflow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	id, err := idParameter(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	proxyToShardOf(w, id, http.MethodGet, scoped(r, "/getWorkflow?id="+id), nil)
+}
+
+func cancelTask(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("cancelTask")
+
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	id, err := idParameter(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	if proxyToShardOf(w, id, http.MethodPost, scoped(r, "/cancelTask?id="+id), nil) == http.StatusOK {
+		go notifyTaskDone(id)
+	}
+}
+
+func registerTaskFailed(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("registerTaskFailed")
+
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	id, err := idParameter(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	if proxyToShardOf(w, id, http.MethodPost, "/failTask?id="+id, nil) == http.StatusOK {
+		go notifyTaskDone(id)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+)
+
+// params : the parameters of the posterize operation, validated by the worker as its manifest tells
+type params struct {
+	Levels float64 `json:"levels"`
+}
+
+func main() {
+	input := bufio.NewReader(os.Stdin)
+	line, err := input.ReadBytes('\n')
+
+	if err != nil {
+		fail("can't read the parameters", err)
+	}
+
+	p := params{}
+
+	if err = json.Unmarshal(line, &p); err != nil {
+		fail("can't parse the parameters", err)
+	}
+
+	img, err := png.Decode(input)
+
+	if err != nil {
+		fail("can't decode the image", err)
+	}
+
+	result := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(result, result.Rect, img, img.Bounds().Min, draw.Src)
+
+	// the validated levels, from 2 to 256
+	step := 255 / (p.Levels - 1)
+
+	for i := range result.Pix {
+		// the alpha is kept
+		if i%4 != 3 {
+			result.Pix[i] = uint8(math.Round(math.Round(float64(result.Pix[i])/step) * step))
+		}
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+
+	if err = png.Encode(output, result); err != nil {
+		fail("can't encode the result", err)
+	}
+
+	if err = output.Flush(); err != nil {
+		fail("can't write the result", err)
+	}
+}
+
+// fail : the worker fails the operation with what the plugin writes on its standard error
+func fail(reason string, err error) {
+	fmt.Fprintln(os.Stderr, reason+":", err.Error())
+	os.Exit(1)
+}
@@ -0,0 +1,48 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// command : a plugin run as an executable, in its directory, without the environment of the worker
+type command struct {
+	path      string
+	args      []string
+	directory string
+	maxMemory int64
+}
+
+func newCommand(directory, name string, args []string, maxMemory int64) (*command, error) {
+	// without ulimit, nothing would keep the plugin under maxMemory
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("command plugins can't be limited in memory on windows, use a wasm module instead")
+	}
+
+	path, err := inDirectory(directory, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &command{path: path, args: args, directory: directory, maxMemory: maxMemory}, nil
+}
+
+// run : starts the executable, killed once ctx is done. Its memory is limited by the shell, with ulimit
+func (command *command) run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+	// ulimit -d takes kilobytes, the shell is replaced by the plugin
+	args := append([]string{"-c", `ulimit -d "$0" && exec "$@"`, strconv.FormatInt(command.maxMemory>>10, 10), command.path}, command.args...)
+	cmd := exec.CommandContext(ctx, "/bin/sh", args...)
+	cmd.Dir = command.directory
+	cmd.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin"}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	// the processes started by the plugin may keep its output open once it is killed
+	cmd.WaitDelay = time.Second
+
+	return cmd.Run()
+}
@@ -0,0 +1,273 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/imageProcessing"
+)
+
+// the defaults of the manifests that don't set their limits
+const (
+	defaultTimeout   = 10 * time.Second
+	defaultMaxMemory = 256 << 20
+	defaultMaxOutput = 64 << 20
+	// what is kept of the standard error of a plugin, for the error of its operation
+	maxErrorOutput = 4 << 10
+)
+
+// the names of the operations, as the built in ones
+var validName = regexp.MustCompile(`^[a-z][a-zA-Z0-9]{0,31}$`)
+
+/*
+Manifest :
+A plugin, described by a JSON file of the plugin directory. It runs either Command,
+an executable, or Wasm, a WebAssembly module using WASI, both relative to the directory.
+Timeout is a duration such as 10s, MaxMemory and MaxOutput are in bytes.
+Commands are limited in memory with ulimit, so only Wasm plugins load on Windows
+*/
+type Manifest struct {
+	Name      string                  `json:"name"`
+	Command   string                  `json:"command"`
+	Args      []string                `json:"args"`
+	Wasm      string                  `json:"wasm"`
+	Params    []imageProcessing.Param `json:"params"`
+	Timeout   string                  `json:"timeout"`
+	MaxMemory int64                   `json:"maxMemory"`
+	MaxOutput int64                   `json:"maxOutput"`
+}
+
+/*
+runner :
+Runs a plugin once, its input on stdin and its result on stdout, until ctx is done.
+An error tells the plugin failed, its standard error being in stderr
+*/
+type runner interface {
+	run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// plugin : a plugin ready to be run as an operation
+type plugin struct {
+	runner    runner
+	timeout   time.Duration
+	maxOutput int64
+}
+
+/*
+Load :
+Registers an operation for the plugin of each JSON file of directory, and returns their names.
+Nothing is loaded when directory is empty, a plugin named as another operation is an error
+*/
+func Load(directory string) ([]string, error) {
+	if len(directory) == 0 {
+		return nil, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(directory, "*.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	names := []string{}
+
+	for _, file := range files {
+		operation, err := load(file)
+
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %s", filepath.Base(file), err.Error())
+		}
+
+		imageProcessing.Register(operation)
+		names = append(names, operation.Name)
+	}
+
+	return names, nil
+}
+
+// load : the operation of the plugin described by the manifest file
+func load(file string) (imageProcessing.Operation, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return imageProcessing.Operation{}, err
+	}
+
+	manifest := Manifest{}
+
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return imageProcessing.Operation{}, err
+	}
+
+	if !validName.MatchString(manifest.Name) {
+		return imageProcessing.Operation{}, fmt.Errorf("invalid name %q, expected up to 32 letters and digits starting with a lowercase letter", manifest.Name)
+	}
+
+	if _, exists := imageProcessing.Lookup(manifest.Name); exists {
+		return imageProcessing.Operation{}, fmt.Errorf("there already is a %s operation", manifest.Name)
+	}
+
+	loaded := &plugin{timeout: defaultTimeout, maxOutput: manifest.MaxOutput}
+
+	if len(manifest.Timeout) != 0 {
+		if loaded.timeout, err = time.ParseDuration(manifest.Timeout); err != nil || loaded.timeout <= 0 {
+			return imageProcessing.Operation{}, fmt.Errorf("invalid timeout %q", manifest.Timeout)
+		}
+	}
+
+	if loaded.maxOutput <= 0 {
+		loaded.maxOutput = defaultMaxOutput
+	}
+
+	maxMemory := manifest.MaxMemory
+
+	if maxMemory <= 0 {
+		maxMemory = defaultMaxMemory
+	}
+
+	// the files of a plugin are relative to the directory of its manifest
+	directory, err := filepath.Abs(filepath.Dir(file))
+
+	if err != nil {
+		return imageProcessing.Operation{}, err
+	}
+
+	switch {
+	case len(manifest.Command) != 0 && len(manifest.Wasm) == 0:
+		loaded.runner, err = newCommand(directory, manifest.Command, manifest.Args, maxMemory)
+	case len(manifest.Wasm) != 0 && len(manifest.Command) == 0 && len(manifest.Args) == 0:
+		loaded.runner, err = newWasm(directory, manifest.Wasm, manifest.Name, maxMemory)
+	default:
+		err = errors.New("a plugin has either a command, with its args, or a wasm module")
+	}
+
+	if err != nil {
+		return imageProcessing.Operation{}, err
+	}
+
+	return imageProcessing.Operation{Name: manifest.Name, Params: manifest.Params, Apply: loaded.apply}, nil
+}
+
+// inDirectory : the path of a file of a plugin, which has to be in its directory
+func inDirectory(directory, name string) (string, error) {
+	path := filepath.Join(directory, name)
+
+	if !strings.HasPrefix(path, directory+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s isn't in the plugin directory", name)
+	}
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", name)
+	}
+
+	return path, nil
+}
+
+/*
+apply :
+Runs the plugin on img. Its input is its parameters as a line of JSON, then img as a PNG image,
+it responds with the resulting image in any format the worker decodes
+*/
+func (plugin *plugin) apply(img image.Image, args imageProcessing.Args) (image.Image, error) {
+	params, err := json.Marshal(args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	input := bytes.NewBuffer(append(params, '\n'))
+
+	if err = png.Encode(input, img); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), plugin.timeout)
+	defer cancel()
+
+	output := &limitedBuffer{max: plugin.maxOutput}
+	errorOutput := &limitedBuffer{max: maxErrorOutput, truncate: true}
+	err = plugin.runner.run(ctx, input, output, errorOutput)
+	result := output.buffer.Bytes()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", plugin.timeout)
+	}
+
+	if output.exceeded {
+		return nil, fmt.Errorf("responded with more than %d bytes", plugin.maxOutput)
+	}
+
+	if err != nil {
+		if message := strings.TrimSpace(errorOutput.buffer.String()); len(message) != 0 {
+			return nil, fmt.Errorf("%s: %s", err.Error(), message)
+		}
+
+		return nil, err
+	}
+
+	if _, err = imageProcessing.ResultLimits.Check(bytes.NewReader(result), int64(len(result))); err != nil {
+		return nil, fmt.Errorf("responded with an invalid image: %s", err.Error())
+	}
+
+	decoded, _, err := imageProcessing.Decode(bytes.NewReader(result))
+
+	if err != nil {
+		return nil, fmt.Errorf("responded with an invalid image: %s", err.Error())
+	}
+
+	return decoded, nil
+}
+
+var errOutputTooLarge = errors.New("output over the limit")
+
+/*
+limitedBuffer :
+A buffer refusing to grow over max bytes, or dropping what is over it when truncate is set.
+It has no ReadFrom, for io.Copy to go through Write
+*/
+type limitedBuffer struct {
+	buffer   bytes.Buffer
+	max      int64
+	truncate bool
+	exceeded bool
+}
+
+func (buffer *limitedBuffer) Write(data []byte) (int, error) {
+	room := buffer.max - int64(buffer.buffer.Len())
+
+	if int64(len(data)) <= room {
+		return buffer.buffer.Write(data)
+	}
+
+	buffer.exceeded = true
+
+	if !buffer.truncate {
+		return 0, errOutputTooLarge
+	}
+
+	if room > 0 {
+		buffer.buffer.Write(data[:room])
+	}
+
+	return len(data), nil
+}
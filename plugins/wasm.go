@@ -0,0 +1,96 @@
+package plugins
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// the size of the pages of WebAssembly memory
+const wasmPageSize = 64 << 10
+
+/*
+wasm :
+A plugin run as a WebAssembly module with the pure Go runtime wazero, compiled on its first run.
+Each run is a new instance, with no files, environment or network, only its standard streams
+*/
+type wasm struct {
+	path      string
+	name      string
+	maxMemory int64
+
+	once     sync.Once
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	err      error
+}
+
+func newWasm(directory, file, name string, maxMemory int64) (*wasm, error) {
+	path, err := inDirectory(directory, file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &wasm{path: path, name: name, maxMemory: maxMemory}, nil
+}
+
+// compile : the runtime of the module, its memory limited and stopping its instances once their context is done
+func (module *wasm) compile() {
+	binary, err := ioutil.ReadFile(module.path)
+
+	if err != nil {
+		module.err = err
+		return
+	}
+
+	ctx := context.Background()
+	pages := module.maxMemory / wasmPageSize
+
+	if pages < 1 {
+		pages = 1
+	}
+
+	if pages > 65536 {
+		pages = 65536
+	}
+
+	module.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(pages)).
+		WithCloseOnContextDone(true))
+
+	if _, module.err = wasi_snapshot_preview1.Instantiate(ctx, module.runtime); module.err != nil {
+		return
+	}
+
+	module.compiled, module.err = module.runtime.CompileModule(ctx, binary)
+}
+
+// run : runs the module as a WASI command, its exit code other than 0 being an error
+func (module *wasm) run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+	module.once.Do(module.compile)
+
+	if module.err != nil {
+		return module.err
+	}
+
+	// anonymous, as several instances run at once
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(module.name).
+		WithStdin(stdin).
+		WithStdout(stdout).
+		WithStderr(stderr)
+
+	instance, err := module.runtime.InstantiateModule(ctx, module.compiled, config)
+
+	if instance != nil {
+		instance.Close(ctx)
+	}
+
+	return err
+}
@@ -0,0 +1,22 @@
+package task
+
+// BatchCreated : the response to a batch creation
+type BatchCreated struct {
+	ID      string   `json:"id"`
+	TaskIDs []string `json:"taskIds"`
+	// the error storing the image of each cancelled task
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Batch : progress of the tasks created together in a batch
+type Batch struct {
+	ID     string      `json:"id"`
+	Total  int         `json:"total"`
+	Counts map[int]int `json:"counts"`
+	Tasks  []Task      `json:"tasks"`
+}
+
+// IsDone : whether every task of the batch reached a state it will never leave
+func (b Batch) IsDone() bool {
+	return b.Counts[StatusFinished]+b.Counts[StatusFailed]+b.Counts[StatusCancelled] == b.Total
+}
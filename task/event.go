@@ -0,0 +1,16 @@
+package task
+
+import (
+	"time"
+)
+
+// Event : a task changed state, events IDs are consecutive
+type Event struct {
+	ID         int       `json:"id"`
+	TaskID     string    `json:"taskId"`
+	WorkflowID string    `json:"workflowId,omitempty"`
+	BatchID    string    `json:"batchId,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	State      int       `json:"state"`
+	Time       time.Time `json:"time"`
+}
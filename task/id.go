@@ -0,0 +1,150 @@
+package task
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// ShardBits : every ID holds the number of the taskStore shard owning it on this many bits
+	ShardBits = 8
+	// MaxShards : shards are numbered from 0 to MaxShards - 1
+	MaxShards = 1 << ShardBits
+
+	// IDLength : IDs are 128 bits written as 26 characters of Crockford's base32
+	IDLength = 26
+
+	alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	// bytes of randomness after the 6 bytes of time and the byte of the shard
+	randomBytes = 9
+)
+
+var decoding [256]byte
+
+func init() {
+	for i := range decoding {
+		decoding[i] = 0xFF
+	}
+
+	for i := 0; i < len(alphabet); i++ {
+		decoding[alphabet[i]] = byte(i)
+	}
+}
+
+/*
+IDGenerator :
+Makes task, batch and workflow IDs in the style of ULIDs:
+48 bits of milliseconds since the epoch, the shard on 8 bits, then 72 random bits.
+IDs of a generator sort in the order they were made, as strings too:
+within a millisecond the random part grows by a random step instead of being redrawn
+*/
+type IDGenerator struct {
+	shard      byte
+	lastTime   uint64
+	lastRandom [randomBytes]byte
+	mutex      sync.Mutex
+}
+
+// NewIDGenerator : the generator of the IDs of shard
+func NewIDGenerator(shard int) *IDGenerator {
+	return &IDGenerator{shard: byte(shard)}
+}
+
+// New : a new ID, greater than every ID this generator made before
+func (generator *IDGenerator) New() string {
+	generator.mutex.Lock()
+	defer generator.mutex.Unlock()
+
+	now := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+
+	if now > generator.lastTime {
+		generator.lastTime = now
+		rand.Read(generator.lastRandom[:])
+	} else if !generator.increment() {
+		// the random part overflowed: borrow the next millisecond
+		generator.lastTime++
+		rand.Read(generator.lastRandom[:])
+	}
+
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], generator.lastTime<<16)
+	id[6] = generator.shard
+	copy(id[7:], generator.lastRandom[:])
+
+	return encode(id)
+}
+
+// increment : adds a random step of at most 32 bits to the random part, false on overflow
+func (generator *IDGenerator) increment() bool {
+	var step [4]byte
+	rand.Read(step[:])
+
+	carry := uint64(binary.BigEndian.Uint32(step[:])) + 1
+
+	for i := randomBytes - 1; i >= 0 && carry != 0; i-- {
+		sum := uint64(generator.lastRandom[i]) + carry
+		generator.lastRandom[i] = byte(sum)
+		carry = sum >> 8
+	}
+
+	return carry == 0
+}
+
+func encode(id [16]byte) string {
+	encoded := make([]byte, IDLength)
+
+	// 130 bits of output for 128 bits of input: the first character only holds 3 bits
+	high := binary.BigEndian.Uint64(id[:8])
+	low := binary.BigEndian.Uint64(id[8:])
+
+	for i := IDLength - 1; i >= 0; i-- {
+		encoded[i] = alphabet[low&31]
+		low = low>>5 | high<<59
+		high >>= 5
+	}
+
+	return string(encoded)
+}
+
+func decode(id string) ([16]byte, error) {
+	var decoded [16]byte
+
+	if len(id) != IDLength {
+		return decoded, errors.New("invalid ID: " + id)
+	}
+
+	var high, low uint64
+
+	for i := 0; i < IDLength; i++ {
+		value := decoding[id[i]]
+
+		if value == 0xFF || (i == 0 && value > 7) {
+			return decoded, errors.New("invalid ID: " + id)
+		}
+
+		high = high<<5 | low>>59
+		low = low<<5 | uint64(value)
+	}
+
+	binary.BigEndian.PutUint64(decoded[:8], high)
+	binary.BigEndian.PutUint64(decoded[8:], low)
+
+	return decoded, nil
+}
+
+// ValidateID : whether id is an ID made by an IDGenerator, in its canonical form
+func ValidateID(id string) error {
+	_, err := decode(id)
+
+	return err
+}
+
+// ShardOf : the shard owning the task, batch or workflow id, which has to be valid
+func ShardOf(id string) int {
+	decoded, _ := decode(id)
+
+	return int(decoded[6])
+}
@@ -0,0 +1,237 @@
+package task
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// SortByID : list tasks by ID
+	SortByID = "id"
+	// SortByCreatedAt : list tasks by creation time
+	SortByCreatedAt = "createdAt"
+	// SortByUpdatedAt : list tasks by time of their last state change
+	SortByUpdatedAt = "updatedAt"
+
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// Listing : a page of tasks matching a ListQuery, counts are for every matching task
+type Listing struct {
+	Tasks      []Task      `json:"tasks"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+	Total      int         `json:"total"`
+	Counts     map[int]int `json:"counts"`
+}
+
+// ListQuery : filters, order and page of a task listing
+type ListQuery struct {
+	States        map[int]bool
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Worker        string
+	Tenant        string
+	SortBy        string
+	Descending    bool
+	Limit         int
+	After         *Cursor
+}
+
+// Cursor : position of the last task of a page, tasks are ordered by sort key then ID
+type Cursor struct {
+	Key int64  `json:"k"`
+	ID  string `json:"id"`
+}
+
+/*
+ParseListQuery :
+Reads the query parameters of a listing:
+state (repeatable), createdAfter and createdBefore (RFC 3339), worker, tenant,
+sort (id, createdAt or updatedAt), order (asc or desc), limit and cursor
+*/
+func ParseListQuery(values url.Values) (ListQuery, error) {
+	query := ListQuery{
+		States: make(map[int]bool),
+		SortBy: SortByCreatedAt,
+		Limit:  defaultListLimit,
+		Worker: values.Get("worker"),
+		Tenant: values.Get("tenant"),
+	}
+
+	for _, strstate := range values["state"] {
+		state, err := strconv.Atoi(strstate)
+
+		if err != nil || !IsValidState(state) {
+			return query, errors.New("invalid state: " + strstate)
+		}
+
+		query.States[state] = true
+	}
+
+	var err error
+
+	if createdAfter := values.Get("createdAfter"); len(createdAfter) != 0 {
+		if query.CreatedAfter, err = time.Parse(time.RFC3339, createdAfter); err != nil {
+			return query, err
+		}
+	}
+
+	if createdBefore := values.Get("createdBefore"); len(createdBefore) != 0 {
+		if query.CreatedBefore, err = time.Parse(time.RFC3339, createdBefore); err != nil {
+			return query, err
+		}
+	}
+
+	switch sortBy := values.Get("sort"); sortBy {
+	case "":
+	case SortByID, SortByCreatedAt, SortByUpdatedAt:
+		query.SortBy = sortBy
+	default:
+		return query, errors.New("invalid sort: " + sortBy)
+	}
+
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, errors.New("invalid order: " + order)
+	}
+
+	if limit := values.Get("limit"); len(limit) != 0 {
+		query.Limit, err = strconv.Atoi(limit)
+
+		if err != nil || query.Limit < 1 || query.Limit > maxListLimit {
+			return query, errors.New("limit must be between 1 and " + strconv.Itoa(maxListLimit))
+		}
+	}
+
+	if cursor := values.Get("cursor"); len(cursor) != 0 {
+		query.After, err = DecodeCursor(cursor)
+
+		if err != nil {
+			return query, errors.New("invalid cursor")
+		}
+	}
+
+	return query, nil
+}
+
+// Matches : whether t passes the filters of the query, regardless of the page
+func (query ListQuery) Matches(t Task) bool {
+	if len(query.States) != 0 && !query.States[t.State] {
+		return false
+	}
+
+	if !query.CreatedAfter.IsZero() && t.CreatedAt.Before(query.CreatedAfter) {
+		return false
+	}
+
+	if !query.CreatedBefore.IsZero() && !t.CreatedAt.Before(query.CreatedBefore) {
+		return false
+	}
+
+	if len(query.Worker) != 0 && t.Worker != query.Worker {
+		return false
+	}
+
+	if len(query.Tenant) != 0 && t.Tenant != query.Tenant {
+		return false
+	}
+
+	return true
+}
+
+// CursorOf : the position of t in the order of the query
+func (query ListQuery) CursorOf(t Task) Cursor {
+	cursor := Cursor{ID: t.ID}
+
+	switch query.SortBy {
+	case SortByCreatedAt:
+		cursor.Key = t.CreatedAt.UnixNano()
+	case SortByUpdatedAt:
+		cursor.Key = t.UpdatedAt.UnixNano()
+	}
+
+	return cursor
+}
+
+// Less : whether a comes before b in the order of the query
+func (query ListQuery) Less(a, b Task) bool {
+	return query.before(query.CursorOf(a), query.CursorOf(b))
+}
+
+func (query ListQuery) before(a, b Cursor) bool {
+	if a == b {
+		return false
+	}
+
+	if a.Key == b.Key {
+		return (a.ID < b.ID) != query.Descending
+	}
+
+	return (a.Key < b.Key) != query.Descending
+}
+
+// IsAfterCursor : whether t belongs after the page the cursor of the query ends
+func (query ListQuery) IsAfterCursor(t Task) bool {
+	return query.After == nil || query.before(*query.After, query.CursorOf(t))
+}
+
+// Encode : the opaque string clients send back to get the next page
+func (cursor Cursor) Encode() string {
+	data, _ := json.Marshal(cursor)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor : reads a cursor made by Encode
+func DecodeCursor(encoded string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := &Cursor{}
+
+	if err = json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+/*
+Paginate :
+Builds the listing of matching tasks, which have to be sorted with query.Less
+*/
+func (query ListQuery) Paginate(matching []Task) Listing {
+	listing := Listing{
+		Tasks:  []Task{},
+		Total:  len(matching),
+		Counts: make(map[int]int),
+	}
+
+	for _, t := range matching {
+		listing.Counts[t.State]++
+
+		if !query.IsAfterCursor(t) {
+			continue
+		}
+
+		if len(listing.Tasks) == query.Limit {
+			listing.NextCursor = query.CursorOf(listing.Tasks[len(listing.Tasks)-1]).Encode()
+			continue
+		}
+
+		listing.Tasks = append(listing.Tasks, t)
+	}
+
+	return listing
+}
@@ -0,0 +1,36 @@
+package task
+
+const (
+	// MetadataStrip : the results of the task carry no metadata, the default
+	MetadataStrip = "strip"
+	// MetadataPreserve : the results of the task keep the EXIF metadata of the upload, location included
+	MetadataPreserve = "preserve"
+)
+
+/*
+ImageInfo :
+What the worker found out about the input of a task. Width and height are those of
+the image as displayed, once turned as its EXIF orientation tells.
+Location tells whether the EXIF metadata had a GPS position, Frames is set for animated GIFs
+*/
+type ImageInfo struct {
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Format      string  `json:"format"`
+	Frames      int     `json:"frames,omitempty"`
+	Orientation int     `json:"orientation,omitempty"`
+	Location    bool    `json:"location,omitempty"`
+	Camera      *Camera `json:"camera,omitempty"`
+}
+
+// Camera : the camera settings of the EXIF metadata, exposure as written by cameras, such as 1/125
+type Camera struct {
+	Make        string  `json:"make,omitempty"`
+	Model       string  `json:"model,omitempty"`
+	Lens        string  `json:"lens,omitempty"`
+	TakenAt     string  `json:"takenAt,omitempty"`
+	Exposure    string  `json:"exposure,omitempty"`
+	FNumber     float64 `json:"fNumber,omitempty"`
+	ISO         int     `json:"iso,omitempty"`
+	FocalLength float64 `json:"focalLength,omitempty"`
+}
@@ -0,0 +1,7 @@
+package task
+
+// Operation : a step of the work on an image, named after an operation of the imageProcessing registry
+type Operation struct {
+	Name   string                 `json:"name"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
@@ -0,0 +1,39 @@
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Output : how the worker encodes the result of a task, PNG by default
+type Output struct {
+	Format string `json:"format,omitempty"`
+	// for the lossy formats, from 1 to 100, 0 for their default
+	Quality int `json:"quality,omitempty"`
+	// MetadataStrip or MetadataPreserve, stripped by default
+	Metadata string `json:"metadata,omitempty"`
+}
+
+// Spec : what to do with an uploaded image, sent along with it
+type Spec struct {
+	Type       string      `json:"type,omitempty"`
+	Operations []Operation `json:"operations,omitempty"`
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+	Output     Output      `json:"output"`
+}
+
+// ParseSpec : the spec in data, unknown fields are rejected so that a typo isn't silently ignored
+func ParseSpec(data []byte) (Spec, error) {
+	spec := Spec{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(&spec)
+
+	return spec, err
+}
+
+// Spec : the type, operations, thumbnails and output of t
+func (t Task) Spec() Spec {
+	return Spec{Type: t.Type, Operations: t.Operations, Thumbnails: t.Thumbnails, Output: t.Output}
+}
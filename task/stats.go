@@ -0,0 +1,37 @@
+package task
+
+// QueueStats : the depth of the queue of a taskStore, or of several shards added together
+type QueueStats struct {
+	Queued     int `json:"queued"`
+	InProgress int `json:"inProgress"`
+	// tasks done per second lately
+	Throughput float64 `json:"throughput"`
+	// seconds until the queued and in progress tasks are done at this throughput, -1 if nothing was done lately
+	EstimatedWait float64 `json:"estimatedWaitSeconds"`
+}
+
+// Add : the stats of both queues, as if they were a single one
+func (stats QueueStats) Add(other QueueStats) QueueStats {
+	sum := QueueStats{
+		Queued:     stats.Queued + other.Queued,
+		InProgress: stats.InProgress + other.InProgress,
+		Throughput: stats.Throughput + other.Throughput,
+	}
+
+	sum.EstimatedWait = EstimateWait(sum.Queued+sum.InProgress, sum.Throughput)
+
+	return sum
+}
+
+// EstimateWait : the seconds needed to do tasks at throughput tasks per second, -1 if it can't be known
+func EstimateWait(tasks int, throughput float64) float64 {
+	if tasks == 0 {
+		return 0
+	}
+
+	if throughput <= 0 {
+		return -1
+	}
+
+	return float64(tasks) / throughput
+}
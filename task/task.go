@@ -1,5 +1,9 @@
 package task
 
+import (
+	"time"
+)
+
 const (
 	// StatusNotStarted : this task isn't started yet
 	StatusNotStarted = 0
@@ -7,17 +11,59 @@ const (
 	StatusInProgress = 1
 	// StatusFinished : this task is done
 	StatusFinished = 2
+	// StatusFailed : the work on this task failed
+	StatusFailed = 3
+	// StatusCancelled : this task was cancelled, or one of the tasks it depends on failed
+	StatusCancelled = 4
 )
 
 /*
 Task :
-Consecutive IDs
+IDs are made by an IDGenerator and sort in creation order
 state :
+
 	0 – not started
 	1 – in progress
 	2 – finished
+	3 – failed
+	4 – cancelled
+
+A task that is part of a workflow is only started once every task
+in dependsOn is finished, and uses the result of dependsOn[0] as its input.
+When callback is set, the master posts a webhook to it once the task is done.
+The worker applies the operations in order, or swaps the reds and greens when there are none,
+and encodes the result as output tells. A thumbnails task also stores
+a thumbnail of the result for each of its sizes.
+Once finished, original describes the input of the task.
+worker is the name of the last worker that started the task.
+A held task isn't given to workers until it is released, once its input is stored
 */
 type Task struct {
-	ID    int `json:"id"`
-	State int `json:"state"`
+	ID         string      `json:"id"`
+	State      int         `json:"state"`
+	Name       string      `json:"name,omitempty"`
+	WorkflowID string      `json:"workflowId,omitempty"`
+	BatchID    string      `json:"batchId,omitempty"`
+	Held       bool        `json:"held,omitempty"`
+	Callback   string      `json:"callback,omitempty"`
+	Worker     string      `json:"worker,omitempty"`
+	Tenant     string      `json:"tenant,omitempty"`
+	DependsOn  []string    `json:"dependsOn,omitempty"`
+	Type       string      `json:"type,omitempty"`
+	Operations []Operation `json:"operations,omitempty"`
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+	Output     Output      `json:"output"`
+	Original   *ImageInfo  `json:"original,omitempty"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	UpdatedAt  time.Time   `json:"updatedAt"`
+}
+
+// IsValidState : whether state is one of the Status constants
+func IsValidState(state int) bool {
+	return state >= StatusNotStarted && state <= StatusCancelled
+}
+
+// IsDone : whether the task reached a state it will never leave
+func (t Task) IsDone() bool {
+	return t.State == StatusFinished || t.State == StatusFailed || t.State == StatusCancelled
 }
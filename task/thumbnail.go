@@ -0,0 +1,72 @@
+package task
+
+import "strconv"
+
+const (
+	// TypeImage : the task stores the image made by its operations
+	TypeImage = ""
+	// TypeThumbnails : the task also stores a thumbnail of that image for each of its sizes
+	TypeThumbnails = "thumbnails"
+)
+
+/*
+Thumbnail :
+A size of a thumbnails task, stored under its variant name.
+Mode and kernel are those of the resize operation, fit and lanczos by default
+*/
+type Thumbnail struct {
+	Variant string `json:"variant,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	Kernel  string `json:"kernel,omitempty"`
+}
+
+// DefaultThumbnails : the sizes of the thumbnails tasks that don't choose any
+var DefaultThumbnails = []Thumbnail{{Width: 128, Height: 128}, {Width: 512, Height: 512}}
+
+// Name : the variant of the thumbnail, thumb-128 for 128x128 or a width of 128 by default
+func (t Thumbnail) Name() string {
+	switch {
+	case len(t.Variant) != 0:
+		return t.Variant
+	case t.Height == 0 || t.Height == t.Width:
+		return "thumb-" + strconv.Itoa(t.Width)
+	case t.Width == 0:
+		return "thumb-x" + strconv.Itoa(t.Height)
+	}
+
+	return "thumb-" + strconv.Itoa(t.Width) + "x" + strconv.Itoa(t.Height)
+}
+
+// Resize : the resize operation making the thumbnail
+func (t Thumbnail) Resize() Operation {
+	params := map[string]interface{}{"mode": "fit", "kernel": "lanczos"}
+
+	if t.Width != 0 {
+		params["width"] = float64(t.Width)
+	}
+
+	if t.Height != 0 {
+		params["height"] = float64(t.Height)
+	}
+
+	if len(t.Mode) != 0 {
+		params["mode"] = t.Mode
+	}
+
+	if len(t.Kernel) != 0 {
+		params["kernel"] = t.Kernel
+	}
+
+	return Operation{Name: "resize", Params: params}
+}
+
+// Sizes : the thumbnails of t, the default ones when it doesn't choose any
+func (t Task) Sizes() []Thumbnail {
+	if len(t.Thumbnails) == 0 {
+		return DefaultThumbnails
+	}
+
+	return t.Thumbnails
+}
@@ -0,0 +1,47 @@
+package task
+
+import (
+	"errors"
+	"strconv"
+)
+
+const (
+	// VariantOriginal : the image uploaded for a task
+	VariantOriginal = "original"
+	// VariantResult : the image made by the operations of a task
+	VariantResult = "result"
+)
+
+// the longest variant or overlay name
+const maxNameLength = 32
+
+// Variant : an image stored for a task, or an overlay image, its content type and its size in bytes
+type Variant struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+}
+
+// ValidateVariant : whether name is a variant name, lowercase letters, digits and dashes, as it ends up in file names
+func ValidateVariant(name string) error {
+	return validateName("variant", name)
+}
+
+// ValidateOverlay : whether name is an overlay name, with the same characters as a variant name
+func ValidateOverlay(name string) error {
+	return validateName("overlay", name)
+}
+
+func validateName(kind, name string) error {
+	if len(name) == 0 || len(name) > maxNameLength {
+		return errors.New("a " + kind + " name has 1 to " + strconv.Itoa(maxNameLength) + " characters")
+	}
+
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return errors.New("invalid " + kind + " name " + strconv.Quote(name) + ", expected lowercase letters, digits and dashes")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package task
+
+import (
+	"errors"
+)
+
+const (
+	// WorkflowPending : no task of the workflow is started yet
+	WorkflowPending = "pending"
+	// WorkflowRunning : some tasks of the workflow are started or finished
+	WorkflowRunning = "running"
+	// WorkflowSucceeded : every task of the workflow is finished
+	WorkflowSucceeded = "succeeded"
+	// WorkflowFailed : a task of the workflow failed
+	WorkflowFailed = "failed"
+	// WorkflowCancelled : a task of the workflow was cancelled
+	WorkflowCancelled = "cancelled"
+)
+
+// WorkflowStep : a task to create as part of a workflow, referencing its parents by name, with an optional spec
+type WorkflowStep struct {
+	Name      string   `json:"name"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+	Spec      *Spec    `json:"spec,omitempty"`
+}
+
+// WorkflowRequest : the body expected to create a workflow
+type WorkflowRequest struct {
+	Tasks []WorkflowStep `json:"tasks"`
+}
+
+// WorkflowCreated : the response to a workflow creation, mapping each step name to its task ID
+type WorkflowCreated struct {
+	ID    string            `json:"id"`
+	Tasks map[string]string `json:"tasks"`
+}
+
+// Workflow : aggregated status of a workflow
+type Workflow struct {
+	ID     string      `json:"id"`
+	State  string      `json:"state"`
+	Counts map[int]int `json:"counts"`
+	Tasks  []Task      `json:"tasks"`
+}
+
+/*
+SortSteps :
+Validates the steps of a workflow and returns them so that every step
+comes after the steps it depends on
+*/
+func (request WorkflowRequest) SortSteps() ([]WorkflowStep, error) {
+	if len(request.Tasks) == 0 {
+		return nil, errors.New("a workflow needs at least one task")
+	}
+
+	steps := make(map[string]WorkflowStep)
+
+	for _, step := range request.Tasks {
+		if len(step.Name) == 0 {
+			return nil, errors.New("every task of a workflow needs a name")
+		}
+
+		if _, exists := steps[step.Name]; exists {
+			return nil, errors.New("duplicate task name: " + step.Name)
+		}
+
+		steps[step.Name] = step
+	}
+
+	for _, step := range request.Tasks {
+		for _, parent := range step.DependsOn {
+			if _, exists := steps[parent]; !exists {
+				return nil, errors.New(step.Name + " depends on unknown task " + parent)
+			}
+		}
+	}
+
+	// depth-first topological sort, keeping the submission order where possible
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	marks := make(map[string]int)
+	sorted := make([]WorkflowStep, 0, len(request.Tasks))
+
+	var visit func(step WorkflowStep) error
+	visit = func(step WorkflowStep) error {
+		switch marks[step.Name] {
+		case visited:
+			return nil
+		case visiting:
+			return errors.New("dependency cycle through " + step.Name)
+		}
+
+		marks[step.Name] = visiting
+
+		for _, parent := range step.DependsOn {
+			if err := visit(steps[parent]); err != nil {
+				return err
+			}
+		}
+
+		marks[step.Name] = visited
+		sorted = append(sorted, step)
+
+		return nil
+	}
+
+	for _, step := range request.Tasks {
+		if err := visit(step); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+// AggregateState : the state of a workflow made of tasks
+func AggregateState(tasks []Task) string {
+	counts := make(map[int]int)
+
+	for _, t := range tasks {
+		counts[t.State]++
+	}
+
+	switch {
+	case counts[StatusFailed] > 0:
+		return WorkflowFailed
+	case counts[StatusCancelled] > 0:
+		return WorkflowCancelled
+	case counts[StatusFinished] == len(tasks):
+		return WorkflowSucceeded
+	case counts[StatusInProgress] > 0 || counts[StatusFinished] > 0:
+		return WorkflowRunning
+	}
+
+	return WorkflowPending
+}
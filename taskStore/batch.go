@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+var (
+	maxBatchSize int
+)
+
+// newBatch : creates count tasks, held until releaseBatch when the held parameter is true
+func newBatch(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("newBatch")
+
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	count, err := strconv.Atoi(values.Get("count"))
+
+	if err != nil || count < 1 || count > maxBatchSize {
+		errorHandling.RespondWithError(w, "count must be between 1 and "+strconv.Itoa(maxBatchSize))
+		return
+	}
+
+	owner, err := ownerOf(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	held := values.Get("held") == "true"
+
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// optional task.Spec of every task of the batch, validated by the master
+	spec := task.Spec{}
+
+	if len(data) != 0 {
+		if spec, err = task.ParseSpec(data); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+	}
+
+	datastoreMutex.Lock()
+
+	created := task.BatchCreated{
+		ID:      ids.New(),
+		TaskIDs: make([]string, 0, count),
+	}
+
+	for i := 0; i < count; i++ {
+		created.TaskIDs = append(created.TaskIDs, addTask(task.Task{
+			BatchID:    created.ID,
+			Held:       held,
+			Tenant:     owner,
+			Type:       spec.Type,
+			Operations: spec.Operations,
+			Thumbnails: spec.Thumbnails,
+			Output:     spec.Output,
+		}).ID)
+	}
+
+	datastoreMutex.Unlock()
+
+	response, err := json.Marshal(created)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+// releaseBatch : gives the held tasks of the batch to the workers
+func releaseBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	id, err := idFromQuery(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	owner, err := ownerOf(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	datastoreMutex.Lock()
+	held := findTasks(func(t task.Task) bool {
+		return t.BatchID == id && t.Held && ownedBy(t, owner)
+	})
+
+	for _, t := range held {
+		t.Held = false
+		putTask(t)
+	}
+	datastoreMutex.Unlock()
+
+	fmt.Println("released", len(held), "tasks of batch", id)
+
+	fmt.Fprint(w, "Success")
+}
+
+func getBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	id, err := idFromQuery(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	owner, err := ownerOf(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	batch := task.Batch{
+		ID:     id,
+		Counts: make(map[int]int),
+	}
+
+	datastoreMutex.RLock()
+	batch.Tasks = findTasks(func(t task.Task) bool {
+		return t.BatchID == id && ownedBy(t, owner)
+	})
+	datastoreMutex.RUnlock()
+
+	for _, t := range batch.Tasks {
+		batch.Counts[t.State]++
+	}
+
+	batch.Total = len(batch.Tasks)
+
+	if batch.Total == 0 {
+		errorHandling.RespondWithError(w, "This batch does not exist")
+		return
+	}
+
+	response, err := json.Marshal(batch)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
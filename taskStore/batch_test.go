@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// TestBatchHeldUntilReleased : a worker polling while the images of a batch are uploaded doesn't get its tasks
+func TestBatchHeldUntilReleased(t *testing.T) {
+	store := newTestKeyValueStore(t)
+	taskStore := startTaskStore(t, store)
+
+	created := task.BatchCreated{}
+
+	if err := json.Unmarshal([]byte(taskStore.post(t, "/newBatch?held=true&count=2")), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	// a task outside of the batch is still given
+	other := taskStore.post(t, "/newTask?callback=")
+
+	poll := func() (task.Task, bool) {
+		response, err := http.Post("http://"+taskStore.address+"/getNewTask?worker=w1", "", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer response.Body.Close()
+		started := task.Task{}
+
+		if response.StatusCode != http.StatusOK {
+			return started, false
+		}
+
+		if err = json.NewDecoder(response.Body).Decode(&started); err != nil {
+			t.Fatal(err)
+		}
+
+		return started, true
+	}
+
+	if started, ok := poll(); !ok || started.ID != other {
+		t.Fatalf("started %+v, expected the task %s", started, other)
+	}
+
+	if started, ok := poll(); ok {
+		t.Fatalf("started the held task %s", started.ID)
+	}
+
+	taskStore.post(t, "/releaseBatch?id="+created.ID)
+
+	for _, id := range created.TaskIDs {
+		if started, ok := poll(); !ok || started.ID != id || started.Held {
+			t.Fatalf("started %+v once released, expected the task %s", started, id)
+		}
+	}
+}
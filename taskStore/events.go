@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+var (
+	// the last eventLogSize events, oldest first
+	eventLog      []task.Event
+	eventLogSize  int
+	lastEventID   int
+	subscribers   map[chan task.Event]bool
+	eventLogMutex sync.Mutex
+)
+
+func initEvents(size int) {
+	eventLog = make([]task.Event, 0, size)
+	eventLogSize = size
+	subscribers = make(map[chan task.Event]bool)
+	eventLogMutex = sync.Mutex{}
+}
+
+/*
+putTask :
+Stores t, and publishes an event if its state changed.
+Every write to the datastore goes through here or deleteTask, must be called with datastoreMutex held
+*/
+func putTask(t task.Task) {
+	previous, existed := datastore[t.ID]
+	changed := !existed || previous.State != t.State
+
+	if changed {
+		t.UpdatedAt = time.Now()
+	}
+
+	if t.IsDone() && existed && !previous.IsDone() {
+		throughput.record()
+	}
+
+	storeTask(t, changed)
+}
+
+// storeTask : stores t as is and logs it for the replicas, must be called with datastoreMutex held
+func storeTask(t task.Task, changed bool) {
+	datastore[t.ID] = t
+	logChange(change{Op: opPut, Task: &t})
+
+	if changed {
+		publish(t)
+	}
+}
+
+// deleteTask : must be called with datastoreMutex held
+func deleteTask(id string) {
+	delete(datastore, id)
+	logChange(change{Op: opDelete, ID: id})
+}
+
+func publish(t task.Task) {
+	eventLogMutex.Lock()
+	defer eventLogMutex.Unlock()
+
+	lastEventID++
+	event := task.Event{
+		ID:         lastEventID,
+		TaskID:     t.ID,
+		WorkflowID: t.WorkflowID,
+		BatchID:    t.BatchID,
+		Tenant:     t.Tenant,
+		State:      t.State,
+		Time:       time.Now(),
+	}
+
+	if len(eventLog) == eventLogSize {
+		eventLog = eventLog[1:]
+	}
+	eventLog = append(eventLog, event)
+
+	for subscriber := range subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// too slow to keep up: the client reconnects with Last-Event-ID
+			delete(subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// subscribe : returns the retained events after lastSeen (none if lastSeen is -1),
+// and a channel receiving the next ones
+func subscribe(lastSeen int) ([]task.Event, chan task.Event) {
+	eventLogMutex.Lock()
+	defer eventLogMutex.Unlock()
+
+	if lastSeen == -1 {
+		lastSeen = lastEventID
+	}
+
+	missed := []task.Event{}
+
+	for _, event := range eventLog {
+		if event.ID > lastSeen {
+			missed = append(missed, event)
+		}
+	}
+
+	subscriber := make(chan task.Event, 64)
+	subscribers[subscriber] = true
+
+	return missed, subscriber
+}
+
+func unsubscribe(subscriber chan task.Event) {
+	eventLogMutex.Lock()
+	defer eventLogMutex.Unlock()
+
+	if subscribers[subscriber] {
+		delete(subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+type eventFilter struct {
+	taskID     string
+	batchID    string
+	workflowID string
+	tenant     string
+}
+
+func parseEventFilter(values url.Values) (eventFilter, error) {
+	filter := eventFilter{
+		taskID:     values.Get("taskId"),
+		batchID:    values.Get("batchId"),
+		workflowID: values.Get("workflowId"),
+		tenant:     values.Get("tenant"),
+	}
+
+	if len(filter.tenant) != 0 {
+		if err := tenant.ValidateID(filter.tenant); err != nil {
+			return filter, err
+		}
+	}
+
+	for _, id := range []string{filter.taskID, filter.batchID, filter.workflowID} {
+		if len(id) != 0 {
+			if err := task.ValidateID(id); err != nil {
+				return filter, err
+			}
+		}
+	}
+
+	return filter, nil
+}
+
+func (filter eventFilter) matches(event task.Event) bool {
+	return (len(filter.taskID) == 0 || event.TaskID == filter.taskID) &&
+		(len(filter.batchID) == 0 || event.BatchID == filter.batchID) &&
+		(len(filter.workflowID) == 0 || event.WorkflowID == filter.workflowID) &&
+		(len(filter.tenant) == 0 || event.Tenant == filter.tenant)
+}
+
+/*
+events :
+Streams task state changes as Server-Sent Events, optionally filtered by
+taskId, batchId or workflowId. A client reconnecting with a Last-Event-ID header
+first receives the events it missed, as long as they are still in the event log
+(Last-Event-ID: 0 replays the whole log), otherwise only new events are sent
+*/
+func events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		errorHandling.RespondWithError(w, "streaming not supported")
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	filter, err := parseEventFilter(values)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	lastSeen := -1
+
+	if lastEventID := r.Header.Get("Last-Event-ID"); len(lastEventID) != 0 {
+		if lastSeen, err = strconv.Atoi(lastEventID); err != nil || lastSeen < 0 {
+			errorHandling.RespondWithError(w, "invalid Last-Event-ID")
+			return
+		}
+	}
+
+	missed, subscriber := subscribe(lastSeen)
+	defer unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for _, event := range missed {
+		if filter.matches(event) {
+			writeEvent(w, event)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(time.Second * 15)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event, open := <-subscriber:
+			if !open {
+				return
+			}
+
+			if filter.matches(event) {
+				writeEvent(w, event)
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event task.Event) {
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		fmt.Println("Error: ", "writeEvent => json.Marshal", err.Error())
+		return
+	}
+
+	fmt.Fprintf(w, "id: %d\nevent: state\ndata: %s\n\n", event.ID, data)
+}
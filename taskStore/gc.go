@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/dataAccess"
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+const (
+	reasonAge   = "age"
+	reasonCount = "count"
+	reasonBytes = "bytes"
+)
+
+// RetentionPolicy : limits on the done tasks kept, a zero value disables a limit
+type RetentionPolicy struct {
+	MaxAge   time.Duration `json:"maxAge"`
+	MaxCount int           `json:"maxCount"`
+	MaxBytes int64         `json:"maxBytes"`
+}
+
+// CollectedTask : a task removed (or that would be removed) by the collector
+type CollectedTask struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	State     int       `json:"state"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Bytes     int64     `json:"bytes"`
+	Reason    string    `json:"reason"`
+}
+
+// CollectionReport : what a collection removes
+type CollectionReport struct {
+	Time           time.Time       `json:"time"`
+	Policy         RetentionPolicy `json:"policy"`
+	DoneTasks      int             `json:"doneTasks"`
+	StoredBytes    int64           `json:"storedBytes"`
+	Collected      []CollectedTask `json:"collected"`
+	CollectedBytes int64           `json:"collectedBytes"`
+}
+
+var retentionPolicy RetentionPolicy
+
+func initCollector(policy RetentionPolicy, interval time.Duration) {
+	retentionPolicy = policy
+
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			// the primary's deletions are replicated
+			if !isPrimary() {
+				continue
+			}
+
+			report, err := collect()
+
+			if err != nil {
+				fmt.Println("Error: ", "collect", err.Error())
+				continue
+			}
+
+			fmt.Println("collected", len(report.Collected), "tasks,", report.CollectedBytes, "bytes")
+		}
+	}()
+}
+
+func storageAddress() (string, error) {
+	return dataAccess.GetValue(os.Args[2], "storageAddress")
+}
+
+// storedBytes : the bytes used in the fileStorage by each task
+func storedBytes(storage string) (map[string]int64, error) {
+	response, err := http.Get("http://" + storage + "/usage")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("Error: " + "unexpected response from the storage => " + string(data))
+	}
+
+	sizes := make(map[string]int64)
+
+	if err = json.Unmarshal(data, &sizes); err != nil {
+		return nil, err
+	}
+
+	// files that aren't images of a task are left alone
+	for name := range sizes {
+		if task.ValidateID(name) != nil {
+			delete(sizes, name)
+		}
+	}
+
+	return sizes, nil
+}
+
+/*
+planCollection :
+Selects the done tasks to remove, oldest first: those older than MaxAge,
+then as many as needed to keep MaxCount done tasks, then as many as needed to
+keep MaxBytes in the fileStorage. Tasks that another task still waits for are kept
+*/
+func planCollection(storage string, policy RetentionPolicy) (CollectionReport, error) {
+	report := CollectionReport{
+		Time:      time.Now(),
+		Policy:    policy,
+		Collected: []CollectedTask{},
+	}
+
+	sizes, err := storedBytes(storage)
+
+	if err != nil {
+		return report, err
+	}
+
+	datastoreMutex.RLock()
+	waitedFor := make(map[string]bool)
+
+	for _, t := range datastore {
+		if !t.IsDone() {
+			for _, parent := range t.DependsOn {
+				waitedFor[parent] = true
+			}
+		}
+	}
+
+	done := findTasks(func(t task.Task) bool {
+		return t.IsDone() && !waitedFor[t.ID]
+	})
+	datastoreMutex.RUnlock()
+
+	sort.SliceStable(done, func(i, j int) bool {
+		return done[i].UpdatedAt.Before(done[j].UpdatedAt)
+	})
+
+	report.DoneTasks = len(done)
+
+	// every shard keeps its own images under MaxBytes
+	for id, size := range sizes {
+		if task.ShardOf(id) == shard {
+			report.StoredBytes += size
+		}
+	}
+
+	kept := len(done)
+	keptBytes := report.StoredBytes
+
+	for _, t := range done {
+		reason := ""
+
+		switch {
+		case policy.MaxAge > 0 && report.Time.Sub(t.UpdatedAt) > policy.MaxAge:
+			reason = reasonAge
+		case policy.MaxCount > 0 && kept > policy.MaxCount:
+			reason = reasonCount
+		case policy.MaxBytes > 0 && keptBytes > policy.MaxBytes:
+			reason = reasonBytes
+		default:
+			continue
+		}
+
+		report.Collected = append(report.Collected, CollectedTask{
+			ID:        t.ID,
+			Tenant:    t.Tenant,
+			State:     t.State,
+			UpdatedAt: t.UpdatedAt,
+			Bytes:     sizes[t.ID],
+			Reason:    reason,
+		})
+		report.CollectedBytes += sizes[t.ID]
+		kept--
+		keptBytes -= sizes[t.ID]
+	}
+
+	return report, nil
+}
+
+/*
+collect :
+Removes the images of the planned tasks from the fileStorage, then the tasks.
+A task whose images couldn't be removed is kept, to be collected next time
+*/
+func collect() (CollectionReport, error) {
+	storage, err := storageAddress()
+
+	if err != nil {
+		return CollectionReport{}, err
+	}
+
+	report, err := planCollection(storage, retentionPolicy)
+
+	if err != nil {
+		return report, err
+	}
+
+	collected := []CollectedTask{}
+	report.CollectedBytes = 0
+
+	for _, candidate := range report.Collected {
+		if err = deleteFromStorage(storage, candidate.ID, candidate.Tenant); err != nil {
+			fmt.Println("Error: ", "collect => can't delete the images of", candidate.ID, err.Error())
+			continue
+		}
+
+		datastoreMutex.Lock()
+		if t, exists := datastore[candidate.ID]; exists && t.IsDone() {
+			deleteTask(candidate.ID)
+		}
+		datastoreMutex.Unlock()
+
+		collected = append(collected, candidate)
+		report.CollectedBytes += candidate.Bytes
+	}
+
+	report.Collected = collected
+	forgetIdempotencyKeys(collected)
+
+	return report, nil
+}
+
+func deleteFromStorage(storage, id, owner string) error {
+	request, err := http.NewRequest(http.MethodDelete, "http://"+storage+"/deleteImage?id="+id+"&tenant="+owner, nil)
+
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.New("Error: " + "unexpected response from the storage => " + response.Status)
+	}
+
+	return nil
+}
+
+// forgetIdempotencyKeys : a retry must not get the ID of a task that doesn't exist anymore
+func forgetIdempotencyKeys(collected []CollectedTask) {
+	collectedIDs := make(map[string]bool)
+
+	for _, t := range collected {
+		collectedIDs[t.ID] = true
+	}
+
+	idempotencyKeysMutex.Lock()
+	defer idempotencyKeysMutex.Unlock()
+
+	for key, record := range idempotencyKeys {
+		if collectedIDs[record.TaskID] {
+			delete(idempotencyKeys, key)
+			logChange(change{Op: opDeleteKey, Key: key})
+		}
+	}
+}
+
+// gcReport : dry run, responds with what the next collection would remove
+func gcReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	storage, err := storageAddress()
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	report, err := planCollection(storage, retentionPolicy)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	response, err := json.Marshal(report)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+)
+
+// IdempotencyKeyHeader : header a client sets to make a task creation safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader : set on the response when an existing task is returned for a key
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+type idempotencyRecord struct {
+	TaskID    string
+	CreatedAt time.Time
+}
+
+var (
+	idempotencyKeys      map[string]idempotencyRecord
+	idempotencyKeysMutex sync.Mutex
+	idempotencyRetention time.Duration
+)
+
+func initIdempotency(retention time.Duration) {
+	idempotencyKeys = make(map[string]idempotencyRecord)
+	idempotencyKeysMutex = sync.Mutex{}
+	idempotencyRetention = retention
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			purgeIdempotencyKeys()
+		}
+	}()
+}
+
+// lookupIdempotencyKey : must be called with idempotencyKeysMutex held
+func lookupIdempotencyKey(key string) (string, bool) {
+	record, ok := idempotencyKeys[key]
+
+	if !ok || time.Since(record.CreatedAt) > idempotencyRetention {
+		return "", false
+	}
+
+	return record.TaskID, true
+}
+
+// storeIdempotencyKey : must be called with idempotencyKeysMutex held
+func storeIdempotencyKey(key string, id string) {
+	record := idempotencyRecord{
+		TaskID:    id,
+		CreatedAt: time.Now(),
+	}
+
+	idempotencyKeys[key] = record
+	logChange(change{Op: opPutKey, Key: key, Record: &record})
+}
+
+func purgeIdempotencyKeys() {
+	idempotencyKeysMutex.Lock()
+	defer idempotencyKeysMutex.Unlock()
+
+	for key, record := range idempotencyKeys {
+		if time.Since(record.CreatedAt) > idempotencyRetention {
+			delete(idempotencyKeys, key)
+		}
+	}
+}
+
+/*
+createTaskIdempotent :
+Creates a task through create, unless the request carries an Idempotency-Key
+that was already used within the retention window, in which case the task ID
+created the first time is returned instead and replayed is true
+*/
+func createTaskIdempotent(r *http.Request, owner string, create func() string) (id string, replayed bool) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+
+	if len(key) == 0 {
+		return create(), false
+	}
+
+	key = ownedKey(key, owner)
+
+	idempotencyKeysMutex.Lock()
+	defer idempotencyKeysMutex.Unlock()
+
+	if id, ok := lookupIdempotencyKey(key); ok {
+		fmt.Println("Idempotency-Key", key, "already used for task", id)
+		return id, true
+	}
+
+	id = create()
+	storeIdempotencyKey(key, id)
+
+	return id, false
+}
+
+// ownedKey : tenants choose their keys, which must not collide with another tenant's
+func ownedKey(key, owner string) string {
+	if len(owner) == 0 {
+		return key
+	}
+
+	return owner + "/" + key
+}
+
+// getByIdempotencyKey : the ID of the task created for the Idempotency-Key of the request, a 404 if there is none
+func getByIdempotencyKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	key := r.Header.Get(IdempotencyKeyHeader)
+
+	if len(key) == 0 {
+		errorHandling.RespondWithError(w, "missing "+IdempotencyKeyHeader+" header")
+		return
+	}
+
+	owner, err := ownerOf(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	idempotencyKeysMutex.Lock()
+	id, ok := lookupIdempotencyKey(ownedKey(key, owner))
+	idempotencyKeysMutex.Unlock()
+
+	if !ok {
+		errorHandling.RespondWithStatus(w, http.StatusNotFound, "no task for this "+IdempotencyKeyHeader)
+		return
+	}
+
+	fmt.Fprint(w, id)
+}
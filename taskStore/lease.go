@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/dataAccess"
+)
+
+// 0 disables leases: replicas are then only promoted through /promote
+var leaseTTL time.Duration
+
+func leaseKey() string {
+	return "databaseLease." + strconv.Itoa(shard)
+}
+
+// leaseValue : "<address of the holder>|<expiry in unix nanoseconds>"
+func leaseValue() string {
+	return os.Args[1] + "|" + strconv.FormatInt(time.Now().Add(leaseTTL).UnixNano(), 10)
+}
+
+// parseLease : the holder of the lease, empty if it expired or nobody holds it
+func parseLease(value string) string {
+	parts := strings.SplitN(value, "|", 2)
+
+	if len(parts) != 2 {
+		return ""
+	}
+
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+
+	if err != nil || time.Now().UnixNano() > expiry {
+		return ""
+	}
+
+	return parts[0]
+}
+
+/*
+renewLease :
+Takes or extends the lease of the shard if nobody else holds it.
+The compare-and-set fails if another taskStore wrote the lease since it was read
+*/
+func renewLease() (held bool, err error) {
+	current, err := dataAccess.GetValue(os.Args[2], leaseKey())
+
+	if err != nil {
+		return false, err
+	}
+
+	if holder := parseLease(current); len(holder) != 0 && holder != os.Args[1] {
+		return false, nil
+	}
+
+	return dataAccess.CompareAndSet(os.Args[2], leaseKey(), current, leaseValue())
+}
+
+/*
+initLease :
+Primaries renew the lease every third of its TTL and step down when they lose it,
+replicas try to take it and are promoted when the primary stopped renewing it
+*/
+func initLease() {
+	if leaseTTL <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			held, err := renewLease()
+
+			switch {
+			case err != nil:
+				// keep the current role until the key-value store answers again
+				fmt.Println("Error: ", "can't renew the lease", err.Error())
+			case held && !isPrimary():
+				promote()
+			case !held && isPrimary():
+				demote()
+			}
+
+			time.Sleep(leaseTTL / 3)
+		}
+	}()
+}
@@ -6,41 +6,94 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/tsauvajon/go-microservices-poc/dataAccess"
+	"github.com/tsauvajon/go-microservices-poc/config"
 	"github.com/tsauvajon/go-microservices-poc/errorHandling"
 	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
 )
 
 var (
-	datastore                  map[int]task.Task
-	datastoreMutex             sync.RWMutex
-	oldestNotFinishedTask      int // can int overflow, use something bigger in production
-	oldestNotFinishedTaskMutex sync.RWMutex
+	datastore      map[string]task.Task
+	datastoreMutex sync.RWMutex
+	// IDs of the tasks that may still be started, oldest first, protected by datastoreMutex
+	queue []string
+	shard int // stored in every ID this taskStore creates
+	ids   *task.IDGenerator
 )
 
 func main() {
-	if !dataAccess.RegisterInKeyValueStore("databaseAddress") {
+	// optional third argument: the number of this shard, when running several taskStores
+	if len(os.Args) > 3 {
+		var err error
+		shard, err = strconv.Atoi(os.Args[3])
+
+		if err != nil || shard < 0 || shard >= task.MaxShards {
+			fmt.Println("Error: ", "the shard must be a number between 0 and", task.MaxShards-1)
+			return
+		}
+	}
+
+	var err error
+	tenants, err = tenant.Load(config.GetString("TENANTS_FILE", ""))
+
+	if err != nil {
+		fmt.Println("Error: ", "can't load the tenants", err.Error())
 		return
 	}
 
-	datastore = make(map[int]task.Task)
+	datastore = make(map[string]task.Task)
 	datastoreMutex = sync.RWMutex{}
+	ids = task.NewIDGenerator(shard)
+
+	initIdempotency(config.GetDuration("TASKSTORE_IDEMPOTENCY_RETENTION", time.Hour*24))
+	maxBatchSize = config.GetInt("TASKSTORE_MAX_BATCH_SIZE", 1000)
+	initEvents(config.GetInt("TASKSTORE_EVENT_LOG_SIZE", 10000))
+	initThroughput(config.GetDuration("TASKSTORE_THROUGHPUT_WINDOW", time.Minute))
+	initCollector(RetentionPolicy{
+		MaxAge:   config.GetDuration("TASKSTORE_RETENTION_MAX_AGE", 0),
+		MaxCount: config.GetInt("TASKSTORE_RETENTION_MAX_COUNT", 0),
+		MaxBytes: int64(config.GetInt("TASKSTORE_RETENTION_MAX_BYTES", 0)),
+	}, config.GetDuration("TASKSTORE_GC_INTERVAL", time.Minute*10))
+
+	if err := initReplication(config.GetString("TASKSTORE_ROLE", rolePrimary), config.GetInt("TASKSTORE_REPLICATION_LOG_SIZE", 10000)); err != nil {
+		fmt.Println("Error: ", err.Error())
+		return
+	}
 
-	oldestNotFinishedTask = 0
-	oldestNotFinishedTaskMutex = sync.RWMutex{}
+	leaseTTL = config.GetDuration("TASKSTORE_LEASE_TTL", 0)
+
+	if !startReplication() {
+		return
+	}
 
 	http.HandleFunc("/getByID", getByID)
-	http.HandleFunc("/newTask", newTask)
-	http.HandleFunc("/getNewTask", getNewTask)
-	http.HandleFunc("/finishTask", finishTask)
-	http.HandleFunc("/setByID", setByID)
+	http.HandleFunc("/getByIdempotencyKey", getByIdempotencyKey)
+	http.HandleFunc("/newTask", primaryOnly(newTask))
+	http.HandleFunc("/getNewTask", primaryOnly(getNewTask))
+	http.HandleFunc("/finishTask", primaryOnly(finishTask))
+	http.HandleFunc("/setByID", primaryOnly(setByID))
+	http.HandleFunc("/failTask", primaryOnly(failTask))
+	http.HandleFunc("/cancelTask", primaryOnly(cancelTask))
+	http.HandleFunc("/newWorkflow", primaryOnly(newWorkflow))
+	http.HandleFunc("/getWorkflow", getWorkflow)
+	http.HandleFunc("/newBatch", primaryOnly(newBatch))
+	http.HandleFunc("/releaseBatch", primaryOnly(releaseBatch))
+	http.HandleFunc("/getBatch", getBatch)
+	http.HandleFunc("/events", events)
+	http.HandleFunc("/gcReport", gcReport)
 	http.HandleFunc("/list", list)
+	http.HandleFunc("/queueStats", queueStats)
+	http.HandleFunc("/replicate", replicate)
+	http.HandleFunc("/replicationStatus", replicationStatus)
+	http.HandleFunc("/promote", promoteHandler)
 
-	http.ListenAndServe(":3331", nil)
+	http.ListenAndServe(os.Args[1], nil)
 }
 
 func getByID(w http.ResponseWriter, r *http.Request) {
@@ -56,14 +109,14 @@ func getByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	strid := values.Get("id")
+	id := values.Get("id")
 
-	if len(strid) == 0 {
-		errorHandling.RespondWithError(w, "Invalid ID")
+	if err = task.ValidateID(id); err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	id, err := strconv.Atoi(strid)
+	owner, err := ownerOf(r)
 
 	if err != nil {
 		errorHandling.RespondWithErrorStack(w, err)
@@ -71,18 +124,14 @@ func getByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	datastoreMutex.RLock()
-	isInError := id >= len(datastore)
+	value, exists := datastore[id]
 	datastoreMutex.RUnlock()
 
-	if isInError {
+	if !exists || !ownedBy(value, owner) {
 		errorHandling.RespondWithError(w, "This ID does not exist")
 		return
 	}
 
-	datastoreMutex.RLock()
-	value := datastore[id]
-	datastoreMutex.RUnlock()
-
 	response, err := json.Marshal(value)
 
 	if err != nil {
@@ -99,15 +148,85 @@ func newTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	datastoreMutex.RLock()
-	taskToAdd := task.Task{
-		ID:    len(datastore),
-		State: task.StatusNotStarted,
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
 	}
-	datastore[taskToAdd.ID] = taskToAdd
-	datastoreMutex.RUnlock()
 
-	fmt.Fprint(w, taskToAdd.ID)
+	owner, err := ownerOf(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	// optional task.Spec, validated by the master
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	spec := task.Spec{}
+
+	if len(data) != 0 {
+		if spec, err = task.ParseSpec(data); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+	}
+
+	id, replayed := createTaskIdempotent(r, owner, func() string {
+		datastoreMutex.Lock()
+		defer datastoreMutex.Unlock()
+
+		return addTask(task.Task{
+			Callback:   values.Get("callback"),
+			Tenant:     owner,
+			Type:       spec.Type,
+			Operations: spec.Operations,
+			Thumbnails: spec.Thumbnails,
+			Output:     spec.Output,
+		}).ID
+	})
+
+	if replayed {
+		w.Header().Set(IdempotentReplayedHeader, "true")
+	}
+
+	fmt.Fprint(w, id)
+}
+
+// addTask : gives t the next ID and stores it as not started, must be called with datastoreMutex held
+func addTask(t task.Task) task.Task {
+	t.ID = ids.New()
+	t.State = task.StatusNotStarted
+	t.CreatedAt = time.Now()
+	queue = append(queue, t.ID)
+	putTask(t)
+
+	return t
+}
+
+// findTasks : the tasks for which match is true, sorted by ID, must be called with datastoreMutex held
+func findTasks(match func(t task.Task) bool) []task.Task {
+	found := []task.Task{}
+
+	for _, t := range datastore {
+		if match(t) {
+			found = append(found, t)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID < found[j].ID
+	})
+
+	return found
 }
 
 func getNewTask(w http.ResponseWriter, r *http.Request) {
@@ -132,48 +251,51 @@ func getNewTask(w http.ResponseWriter, r *http.Request) {
 	}
 
 	taskToSend := task.Task{
-		ID:    -1,
 		State: task.StatusNotStarted,
 	}
 
-	oldestNotFinishedTaskMutex.Lock()
 	datastoreMutex.Lock()
 
-	fmt.Println("oldestNotFinishedTask:", oldestNotFinishedTask)
+	fmt.Println("queued tasks:", len(queue))
+
+	// done tasks leave the queue, collected tasks were done
+	pending := queue[:0]
+	inProgress := make(map[string]int)
 
-	for i := oldestNotFinishedTask; i < len(datastore); i++ {
-		fmt.Println("checking tasks. ID:", datastore[i].ID, "State:", datastore[i].State)
-		if i == oldestNotFinishedTask && datastore[i].State == task.StatusFinished {
-			oldestNotFinishedTask++
-			continue
+	for _, id := range queue {
+		if t, exists := datastore[id]; exists && !t.IsDone() {
+			pending = append(pending, id)
+
+			if t.State == task.StatusInProgress {
+				inProgress[t.Tenant]++
+			}
 		}
+	}
+
+	queue = pending
 
-		if datastore[i].State == task.StatusNotStarted {
-			taskToSend = datastore[i]
+	for _, id := range queue {
+		t := datastore[id]
+
+		fmt.Println("checking tasks. ID:", t.ID, "State:", t.State)
+
+		if t.State == task.StatusNotStarted && !t.Held && parentsFinished(t) && underConcurrencyQuota(t, inProgress) {
+			taskToSend = t
+			taskToSend.State = task.StatusInProgress
+			taskToSend.Worker = r.URL.Query().Get("worker")
+			putTask(taskToSend)
 			break
 		}
 	}
 
-	oldestNotFinishedTaskMutex.Unlock()
 	datastoreMutex.Unlock()
 
-	if taskToSend.ID == -1 {
+	if len(taskToSend.ID) == 0 {
 		errorHandling.RespondWithError(w, "no available task")
 		return
 	}
 
-	id := taskToSend.ID
-
-	go func() {
-		time.Sleep(time.Minute * 2)
-		datastoreMutex.Lock()
-		datastore[id] = task.Task{
-			ID:    id,
-			State: task.StatusNotStarted,
-		}
-		// set oldestNotFinishedTask to id ?
-		datastoreMutex.Unlock()
-	}()
+	requeueLater(taskToSend.ID)
 
 	// taskToSend.ID: 0 taskToSend.State 0
 	fmt.Println("taskToSend.ID:", taskToSend.ID, "taskToSend.State", taskToSend.State)
@@ -191,6 +313,19 @@ func getNewTask(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(response))
 }
 
+// requeueLater : gives the task back to another worker if this one didn't finish it in time
+func requeueLater(id string) {
+	go func() {
+		time.Sleep(time.Minute * 2)
+		datastoreMutex.Lock()
+		if t, exists := datastore[id]; exists && t.State == task.StatusInProgress {
+			t.State = task.StatusNotStarted
+			putTask(t)
+		}
+		datastoreMutex.Unlock()
+	}()
+}
+
 func finishTask(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("finishTask")
 
@@ -207,42 +342,51 @@ func finishTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	strid := values.Get("id")
+	id := values.Get("id")
 
-	if len(strid) == 0 {
-		errorHandling.RespondWithError(w, "Invalid ID")
+	if err = task.ValidateID(id); err != nil {
+		fmt.Println("taskStore :211 : ", err.Error())
+		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	id, err := strconv.Atoi(strid)
+	// what the worker found out about the input, absent from older workers
+	var original *task.ImageInfo
+	data, err := ioutil.ReadAll(r.Body)
 
 	if err != nil {
-		fmt.Println("taskStore :211 : ", err.Error())
 		errorHandling.RespondWithErrorStack(w, err)
 		return
 	}
 
-	updatedTask := task.Task{
-		ID:    id,
-		State: task.StatusFinished,
+	if len(data) > 0 {
+		original = &task.ImageInfo{}
+
+		if err = json.Unmarshal(data, original); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
 	}
 
-	fmt.Println("updating task => ID:", updatedTask.ID, "State:", updatedTask.State)
+	fmt.Println("updating task => ID:", id, "State:", task.StatusFinished)
 
 	isInError := false
 
-	datastoreMutex.RLock()
+	datastoreMutex.Lock()
 
-	if datastore[id].State != task.StatusInProgress {
+	if updatedTask, ok := datastore[id]; !ok || updatedTask.State != task.StatusInProgress {
 		isInError = true
 	} else {
-		datastore[id] = updatedTask
+		updatedTask.State = task.StatusFinished
+		updatedTask.Original = original
+		putTask(updatedTask)
 		fmt.Println("datastore length:", len(datastore))
 	}
-	datastoreMutex.RUnlock()
+	datastoreMutex.Unlock()
 
 	if isInError {
 		errorHandling.RespondWithError(w, "wrong input")
+		return
 	}
 
 	fmt.Fprint(w, "Success")
@@ -273,34 +417,18 @@ func setByID(w http.ResponseWriter, r *http.Request) {
 
 	isInError := false
 
-	datastoreMutex.RLock()
-	if taskToSet.ID >= len(datastore) || taskToSet.State < task.StatusNotStarted || taskToSet.State > task.StatusFinished {
+	datastoreMutex.Lock()
+	if _, exists := datastore[taskToSet.ID]; !exists || !task.IsValidState(taskToSet.State) {
 		isInError = true
 	} else {
-		datastore[taskToSet.ID] = taskToSet
+		putTask(taskToSet)
 	}
-	datastoreMutex.RUnlock()
+	datastoreMutex.Unlock()
 
 	if isInError {
 		errorHandling.RespondWithError(w, "wrong input")
-	}
-
-	fmt.Fprint(w, "Success")
-}
-
-func list(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		errorHandling.RespondOnlyXAccepted(w, "GET")
 		return
 	}
 
-	for key, value := range datastore {
-		json, err := json.Marshal(value)
-
-		if err != nil {
-			errorHandling.RespondWithErrorStack(w, err)
-			return
-		}
-		fmt.Fprintln(w, key, ": ", json)
-	}
+	fmt.Fprint(w, "Success")
 }
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/dataAccess"
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+
+	opPut       = "put"
+	opDelete    = "delete"
+	opPutKey    = "putKey"
+	opDeleteKey = "deleteKey"
+	opSnapshot  = "snapshot"
+	opHeartbeat = "heartbeat"
+
+	replicationHeartbeat = time.Second * 5
+)
+
+/*
+change :
+One write to the state of the taskStore, in the order the primary made it.
+Replicas apply the changes through the same functions, so their log stays numbered like the primary's
+*/
+type change struct {
+	Seq      int                `json:"seq"`
+	Op       string             `json:"op"`
+	Task     *task.Task         `json:"task,omitempty"`
+	ID       string             `json:"id,omitempty"`
+	Key      string             `json:"key,omitempty"`
+	Record   *idempotencyRecord `json:"record,omitempty"`
+	Snapshot *snapshot          `json:"snapshot,omitempty"`
+}
+
+// snapshot : the whole state, sent to a replica too far behind to catch up from the log
+type snapshot struct {
+	Tasks           []task.Task                  `json:"tasks"`
+	IdempotencyKeys map[string]idempotencyRecord `json:"idempotencyKeys"`
+}
+
+var (
+	role      string
+	roleMutex sync.RWMutex
+	// cancels the stream from the primary when this replica is promoted
+	stopFollowing context.CancelFunc
+
+	// the last replicationLogSize changes, oldest first
+	replicationLog     []change
+	replicationLogSize int
+	lastChangeSeq      int
+	replicas           map[chan change]bool
+	replicationMutex   sync.Mutex
+	resyncFromPrimary  bool // the local state diverged, the next stream starts with a snapshot
+	resyncMutex        sync.Mutex
+)
+
+func initReplication(initialRole string, logSize int) error {
+	if initialRole != rolePrimary && initialRole != roleReplica {
+		return errors.New("TASKSTORE_ROLE must be " + rolePrimary + " or " + roleReplica)
+	}
+
+	replicationLog = make([]change, 0, logSize)
+	replicationLogSize = logSize
+	replicas = make(map[chan change]bool)
+	role = initialRole
+
+	return nil
+}
+
+/*
+startReplication :
+Registers a primary, or starts following the primary of the shard.
+A primary starts as a replica if another taskStore holds the lease of the shard
+*/
+func startReplication() bool {
+	if isPrimary() && leaseTTL > 0 {
+		if held, err := renewLease(); err != nil || !held {
+			fmt.Println("Warning: ", "the lease of", primaryKey(), "isn't available, starting as a replica")
+			role = roleReplica
+		}
+	}
+
+	initLease()
+
+	if !isPrimary() {
+		go follow()
+		return true
+	}
+
+	return registerAsPrimary()
+}
+
+func isPrimary() bool {
+	roleMutex.RLock()
+	defer roleMutex.RUnlock()
+
+	return role == rolePrimary
+}
+
+func primaryKey() string {
+	return "databaseShard." + strconv.Itoa(shard)
+}
+
+// registerAsPrimary : points the master and the replicas of this shard to this taskStore
+func registerAsPrimary() bool {
+	if !dataAccess.RegisterInKeyValueStore(primaryKey()) {
+		return false
+	}
+
+	// the address of the first shard is the one of the whole taskStore when there is only one
+	return shard != 0 || dataAccess.RegisterInKeyValueStore("databaseAddress")
+}
+
+// logChange : numbers c and sends it to the replicas, must be called with the lock of the changed state held
+func logChange(c change) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	lastChangeSeq++
+	c.Seq = lastChangeSeq
+
+	if len(replicationLog) == replicationLogSize {
+		replicationLog = replicationLog[1:]
+	}
+	replicationLog = append(replicationLog, c)
+
+	for replica := range replicas {
+		select {
+		case replica <- c:
+		default:
+			// too slow to keep up: the replica reconnects and catches up from the log or a snapshot
+			delete(replicas, replica)
+			close(replica)
+		}
+	}
+}
+
+/*
+subscribeChanges :
+Returns the changes after from, or a snapshot if they aren't all in the log anymore,
+and a channel receiving the next ones. Every lock is taken so nothing changes in between
+*/
+func subscribeChanges(from int) ([]change, chan change) {
+	idempotencyKeysMutex.Lock()
+	defer idempotencyKeysMutex.Unlock()
+	datastoreMutex.RLock()
+	defer datastoreMutex.RUnlock()
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	firstRetained := lastChangeSeq + 1
+
+	if len(replicationLog) != 0 {
+		firstRetained = replicationLog[0].Seq
+	}
+
+	missed := []change{}
+
+	if from < 0 || from+1 < firstRetained || from > lastChangeSeq {
+		state := &snapshot{
+			Tasks:           findTasks(func(task.Task) bool { return true }),
+			IdempotencyKeys: make(map[string]idempotencyRecord),
+		}
+
+		for key, record := range idempotencyKeys {
+			state.IdempotencyKeys[key] = record
+		}
+
+		missed = append(missed, change{Seq: lastChangeSeq, Op: opSnapshot, Snapshot: state})
+	} else {
+		for _, c := range replicationLog {
+			if c.Seq > from {
+				missed = append(missed, c)
+			}
+		}
+	}
+
+	replica := make(chan change, 1024)
+	replicas[replica] = true
+
+	return missed, replica
+}
+
+func unsubscribeChanges(replica chan change) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	if replicas[replica] {
+		delete(replicas, replica)
+		close(replica)
+	}
+}
+
+/*
+replicate :
+Streams the changes after the sequence number "from" as JSON lines, starting
+with a snapshot when from is -1 or too old. Heartbeats are sent when nothing changes
+*/
+func replicate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	if !isPrimary() {
+		errorHandling.RespondWithStatus(w, http.StatusServiceUnavailable, "this taskStore is a replica")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		errorHandling.RespondWithError(w, "streaming not supported")
+		return
+	}
+
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+
+	if err != nil {
+		errorHandling.RespondWithError(w, "invalid from")
+		return
+	}
+
+	fmt.Println("replica", r.RemoteAddr, "following from", from)
+
+	missed, replica := subscribeChanges(from)
+	defer unsubscribeChanges(replica)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+
+	for _, c := range missed {
+		if err := encoder.Encode(c); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if err := encoder.Encode(change{Op: opHeartbeat}); err != nil {
+				return
+			}
+		case c, open := <-replica:
+			if !open {
+				return
+			}
+
+			if err := encoder.Encode(c); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
+
+// follow : applies the changes of the primary of this shard until this replica is promoted
+func follow() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	roleMutex.Lock()
+	stopFollowing = cancel
+	roleMutex.Unlock()
+
+	for ctx.Err() == nil {
+		primary, err := dataAccess.GetValue(os.Args[2], primaryKey())
+
+		if err == nil && (len(primary) == 0 || primary == os.Args[1]) {
+			err = errors.New("no other primary registered for " + primaryKey())
+		}
+
+		if err == nil {
+			err = followPrimary(ctx, primary)
+		}
+
+		if ctx.Err() == nil {
+			fmt.Println("Error: ", "replication stopped, retrying", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func followPrimary(ctx context.Context, primary string) error {
+	resyncMutex.Lock()
+	from := -1
+
+	if !resyncFromPrimary {
+		replicationMutex.Lock()
+		from = lastChangeSeq
+		replicationMutex.Unlock()
+	}
+	resyncMutex.Unlock()
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+primary+"/replicate?from="+strconv.Itoa(from), nil)
+
+	if err != nil {
+		return err
+	}
+
+	// a primary that stops sending heartbeats is considered gone
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := time.AfterFunc(replicationHeartbeat*3, cancel)
+	defer watchdog.Stop()
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.New("Error: " + "unexpected response from the primary => " + response.Status)
+	}
+
+	fmt.Println("following the primary", primary, "from", from)
+
+	resyncMutex.Lock()
+	resyncFromPrimary = false
+	resyncMutex.Unlock()
+
+	reader := bufio.NewReader(response.Body)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if err != nil {
+			return err
+		}
+
+		watchdog.Reset(replicationHeartbeat * 3)
+
+		c := change{}
+
+		if err = json.Unmarshal(line, &c); err != nil {
+			return err
+		}
+
+		if err = apply(c); err != nil {
+			resyncMutex.Lock()
+			resyncFromPrimary = true
+			resyncMutex.Unlock()
+
+			return err
+		}
+	}
+}
+
+// apply : makes the change of the primary locally, taking the same locks as the handlers would
+func apply(c change) error {
+	switch c.Op {
+	case opHeartbeat:
+		return nil
+	case opSnapshot:
+		restore(c.Seq, c.Snapshot)
+		return nil
+	case opPut:
+		datastoreMutex.Lock()
+		previous, existed := datastore[c.Task.ID]
+
+		if !existed {
+			queue = append(queue, c.Task.ID)
+		}
+
+		storeTask(*c.Task, !existed || previous.State != c.Task.State)
+		datastoreMutex.Unlock()
+	case opDelete:
+		datastoreMutex.Lock()
+		deleteTask(c.ID)
+		datastoreMutex.Unlock()
+	case opPutKey:
+		idempotencyKeysMutex.Lock()
+		idempotencyKeys[c.Key] = *c.Record
+		logChange(c)
+		idempotencyKeysMutex.Unlock()
+	case opDeleteKey:
+		idempotencyKeysMutex.Lock()
+		delete(idempotencyKeys, c.Key)
+		logChange(c)
+		idempotencyKeysMutex.Unlock()
+	default:
+		return errors.New("unknown replication op: " + c.Op)
+	}
+
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	if lastChangeSeq != c.Seq {
+		return errors.New("replication out of order: applied " + strconv.Itoa(lastChangeSeq) + ", received " + strconv.Itoa(c.Seq))
+	}
+
+	return nil
+}
+
+// restore : replaces the whole state with the snapshot of the primary, taken at seq
+func restore(seq int, state *snapshot) {
+	idempotencyKeysMutex.Lock()
+	defer idempotencyKeysMutex.Unlock()
+	datastoreMutex.Lock()
+	defer datastoreMutex.Unlock()
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	datastore = make(map[string]task.Task, len(state.Tasks))
+	queue = []string{}
+
+	// the tasks are sorted by ID, so in creation order
+	for _, t := range state.Tasks {
+		datastore[t.ID] = t
+
+		if !t.IsDone() {
+			queue = append(queue, t.ID)
+		}
+	}
+
+	idempotencyKeys = state.IdempotencyKeys
+
+	replicationLog = replicationLog[:0]
+	lastChangeSeq = seq
+
+	fmt.Println("restored a snapshot of", len(state.Tasks), "tasks at", seq)
+}
+
+/*
+promote :
+Makes this replica the primary of its shard: stops following, registers its
+address in the key-value store and gives back the tasks in progress, as the
+requeue timers of the former primary are lost
+*/
+func promote() bool {
+	roleMutex.Lock()
+
+	if role == rolePrimary {
+		roleMutex.Unlock()
+		return true
+	}
+
+	role = rolePrimary
+
+	if stopFollowing != nil {
+		stopFollowing()
+	}
+	roleMutex.Unlock()
+
+	if !registerAsPrimary() {
+		return false
+	}
+
+	datastoreMutex.RLock()
+	inProgress := findTasks(func(t task.Task) bool {
+		return t.State == task.StatusInProgress
+	})
+	datastoreMutex.RUnlock()
+
+	for _, t := range inProgress {
+		requeueLater(t.ID)
+	}
+
+	fmt.Println("promoted to primary of", primaryKey())
+
+	return true
+}
+
+// demote : another taskStore became the primary, what this one did since can't be trusted anymore
+func demote() {
+	roleMutex.Lock()
+
+	if role == roleReplica {
+		roleMutex.Unlock()
+		return
+	}
+
+	role = roleReplica
+	roleMutex.Unlock()
+
+	resyncMutex.Lock()
+	resyncFromPrimary = true
+	resyncMutex.Unlock()
+
+	fmt.Println("demoted to replica of", primaryKey())
+
+	go follow()
+}
+
+// primaryOnly : replicas only serve reads, writes have to go to the primary
+func primaryOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isPrimary() {
+			errorHandling.RespondWithStatus(w, http.StatusServiceUnavailable, "this taskStore is a replica, send writes to the primary")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// promoteHandler : manual failover, the replica takes the lease over if leases are enabled
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	if leaseTTL > 0 {
+		if err := dataAccess.SetValue(os.Args[2], leaseKey(), leaseValue()); err != nil {
+			errorHandling.RespondWithErrorStack(w, err)
+			return
+		}
+	}
+
+	if !promote() {
+		errorHandling.RespondWithError(w, "can't register as the primary")
+		return
+	}
+
+	fmt.Fprint(w, "Success")
+}
+
+// ReplicationStatus : the role of a taskStore and the last change it made or applied
+type ReplicationStatus struct {
+	Role     string `json:"role"`
+	Seq      int    `json:"seq"`
+	Replicas int    `json:"replicas"`
+}
+
+func replicationStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	roleMutex.RLock()
+	status := ReplicationStatus{Role: role}
+	roleMutex.RUnlock()
+
+	replicationMutex.Lock()
+	status.Seq = lastChangeSeq
+	status.Replicas = len(replicas)
+	replicationMutex.Unlock()
+
+	response, err := json.Marshal(status)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
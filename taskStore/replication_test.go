@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+// the arguments of a taskStore run by the test binary, see startTaskStore
+const testArgsVariable = "TASKSTORE_TEST_ARGS"
+
+// TestMain : the test binary runs a taskStore when asked, the state of one being global to its process
+func TestMain(m *testing.M) {
+	if args := os.Getenv(testArgsVariable); len(args) != 0 {
+		os.Args = append(os.Args[:1], strings.Fields(args)...)
+		main()
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
+
+// testKeyValueStore : the endpoints of the keyValueStore the taskStores use, compare-and-set included
+type testKeyValueStore struct {
+	server *httptest.Server
+	values map[string]string
+	mutex  sync.Mutex
+}
+
+func newTestKeyValueStore(t *testing.T) *testKeyValueStore {
+	store := &testKeyValueStore{values: make(map[string]string)}
+	store.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+
+		switch r.URL.Path {
+		case "/get":
+			fmt.Fprint(w, store.values[query.Get("key")])
+		case "/set":
+			if expected, ok := query["ifValue"]; ok && store.values[query.Get("key")] != expected[0] {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+
+			store.values[query.Get("key")] = query.Get("value")
+		case "/list":
+			found := make(map[string]string)
+
+			for key, value := range store.values {
+				if strings.HasPrefix(key, query.Get("prefix")) {
+					found[key] = value
+				}
+			}
+
+			json.NewEncoder(w).Encode(found)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(store.server.Close)
+
+	return store
+}
+
+func (store *testKeyValueStore) address() string {
+	return strings.TrimPrefix(store.server.URL, "http://")
+}
+
+func (store *testKeyValueStore) get(key string) string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.values[key]
+}
+
+func (store *testKeyValueStore) set(key, value string) {
+	store.mutex.Lock()
+	store.values[key] = value
+	store.mutex.Unlock()
+}
+
+// testTaskStore : a taskStore process, its output shown when the test fails
+type testTaskStore struct {
+	address string
+	cmd     *exec.Cmd
+	output  *bytes.Buffer
+}
+
+// freeAddress : a local address nothing listens on
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// startTaskStore : runs a taskStore of shard 0 with the environment env, once it answers
+func startTaskStore(t *testing.T, store *testKeyValueStore, env ...string) *testTaskStore {
+	taskStore := &testTaskStore{address: freeAddress(t), output: &bytes.Buffer{}}
+	taskStore.cmd = exec.Command(os.Args[0], "-test.run=^$")
+	taskStore.cmd.Env = append(os.Environ(), append(env, testArgsVariable+"="+taskStore.address+" "+store.address())...)
+	taskStore.cmd.Stdout, taskStore.cmd.Stderr = taskStore.output, taskStore.output
+
+	if err := taskStore.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		taskStore.stop()
+
+		if t.Failed() {
+			t.Logf("output of the taskStore %s:\n%s", taskStore.address, lastLines(taskStore.output.String(), 30))
+		}
+	})
+
+	eventually(t, "the taskStore to answer", func() bool {
+		_, err := http.Get("http://" + taskStore.address + "/replicationStatus")
+
+		return err == nil
+	})
+
+	return taskStore
+}
+
+func (taskStore *testTaskStore) stop() {
+	taskStore.cmd.Process.Kill()
+	taskStore.cmd.Wait()
+}
+
+func (taskStore *testTaskStore) status(t *testing.T) ReplicationStatus {
+	status := ReplicationStatus{}
+	taskStore.get(t, "/replicationStatus", &status)
+
+	return status
+}
+
+// tasks : every task of the taskStore, in creation order
+func (taskStore *testTaskStore) tasks(t *testing.T) []task.Task {
+	listing := task.Listing{}
+	taskStore.get(t, "/list?limit=500", &listing)
+
+	return listing.Tasks
+}
+
+func (taskStore *testTaskStore) get(t *testing.T, path string, value interface{}) {
+	response, err := http.Get("http://" + taskStore.address + path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	if err = json.NewDecoder(response.Body).Decode(value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// post : the body of the response, which has to be a 200
+func (taskStore *testTaskStore) post(t *testing.T, path string) string {
+	response, err := http.Post("http://"+taskStore.address+path, "application/json", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s %s", path, response.Status, data)
+	}
+
+	return string(data)
+}
+
+// work : creates tasks, then starts, finishes and cancels some of them
+func (taskStore *testTaskStore) work(t *testing.T, tasks int) []string {
+	created := make([]string, 0, tasks)
+
+	for i := 0; i < tasks; i++ {
+		created = append(created, taskStore.post(t, "/newTask?callback="))
+	}
+
+	started := task.Task{}
+
+	if err := json.Unmarshal([]byte(taskStore.post(t, "/getNewTask?worker=w1")), &started); err != nil {
+		t.Fatal(err)
+	}
+
+	taskStore.post(t, "/finishTask?id="+started.ID)
+	taskStore.post(t, "/cancelTask?id="+created[len(created)-1])
+
+	return created
+}
+
+// converged : waits until the replica has the same changes and tasks as the primary
+func converged(t *testing.T, primary, replica *testTaskStore) {
+	eventually(t, "the replica to converge", func() bool {
+		return primary.status(t).Seq == replica.status(t).Seq && reflect.DeepEqual(primary.tasks(t), replica.tasks(t))
+	})
+}
+
+// states : the state of each task by ID
+func states(tasks []task.Task) map[string]int {
+	found := make(map[string]int)
+
+	for _, t := range tasks {
+		found[t.ID] = t.State
+	}
+
+	return found
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func lastLines(text string, n int) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// TestReplicaConverges : a replica starting after the primary gets a snapshot, then every change as it is made
+func TestReplicaConverges(t *testing.T) {
+	store := newTestKeyValueStore(t)
+	primary := startTaskStore(t, store, "TASKSTORE_ROLE=primary")
+	primary.work(t, 5)
+
+	replica := startTaskStore(t, store, "TASKSTORE_ROLE=replica")
+	converged(t, primary, replica)
+
+	primary.work(t, 3)
+	converged(t, primary, replica)
+
+	if status := primary.status(t); status.Role != rolePrimary || status.Replicas != 1 {
+		t.Errorf("unexpected status of the primary %+v", status)
+	}
+
+	if status := replica.status(t); status.Role != roleReplica {
+		t.Errorf("unexpected status of the replica %+v", status)
+	}
+
+	// replicas only serve reads
+	if response, err := http.Post("http://"+replica.address+"/newTask", "application/json", nil); err != nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("a replica accepted a write: %v", err)
+	}
+}
+
+// readChanges : the changes the primary streams after from, within half a second
+func readChanges(t *testing.T, primary *testTaskStore, from int) []change {
+	response, err := http.Get("http://" + primary.address + "/replicate?from=" + strconv.Itoa(from))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream never ends: it is read for as long as the changes come
+	timer := time.AfterFunc(500*time.Millisecond, func() { response.Body.Close() })
+	defer timer.Stop()
+
+	changes := []change{}
+	reader := bufio.NewReader(response.Body)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if err != nil {
+			return changes
+		}
+
+		c := change{}
+
+		if err = json.Unmarshal(line, &c); err != nil {
+			t.Fatal(err)
+		}
+
+		changes = append(changes, c)
+	}
+}
+
+// TestReplicateCatchUp : the primary streams the changes in order from the log, or a snapshot when they left it
+func TestReplicateCatchUp(t *testing.T) {
+	store := newTestKeyValueStore(t)
+	primary := startTaskStore(t, store, "TASKSTORE_ROLE=primary", "TASKSTORE_REPLICATION_LOG_SIZE=8")
+	primary.work(t, 8)
+	last, tasks := primary.status(t).Seq, len(primary.tasks(t))
+
+	if last <= 9 {
+		t.Fatalf("only %d changes, the log has to be full", last)
+	}
+
+	tests := []struct {
+		name     string
+		from     int
+		snapshot bool
+	}{
+		{name: "from the start of the log", from: last - 8},
+		{name: "from the middle of the log", from: last - 3},
+		{name: "up to date", from: last},
+		{name: "before the log", from: last - 9, snapshot: true},
+		{name: "a new replica", from: -1, snapshot: true},
+		{name: "ahead of the primary", from: last + 1, snapshot: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := readChanges(t, primary, test.from)
+
+			if test.snapshot {
+				if len(changes) != 1 || changes[0].Op != opSnapshot || changes[0].Seq != last || len(changes[0].Snapshot.Tasks) != tasks {
+					t.Fatalf("expected a snapshot of %d tasks at %d, got %+v", tasks, last, changes)
+				}
+
+				return
+			}
+
+			if len(changes) != last-test.from {
+				t.Fatalf("%d changes from %d, expected %d", len(changes), test.from, last-test.from)
+			}
+
+			for i, c := range changes {
+				if c.Seq != test.from+1+i || c.Op == opSnapshot {
+					t.Fatalf("change %d is %s at %d, expected the change at %d", i, c.Op, c.Seq, test.from+1+i)
+				}
+			}
+		})
+	}
+}
+
+/*
+TestReplicaResync :
+A replica receiving a change out of order stops, and resyncs from a snapshot
+instead of going on from its own state, which can't be trusted anymore
+*/
+func TestReplicaResync(t *testing.T) {
+	ids := task.NewIDGenerator(0)
+	tasks := []task.Task{{ID: ids.New(), State: task.StatusFinished}, {ID: ids.New(), State: task.StatusNotStarted}}
+	stray := task.Task{ID: ids.New()}
+
+	froms := make(chan string, 10)
+	streams := 0
+	mutex := sync.Mutex{}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/replicate" {
+			http.NotFound(w, r)
+			return
+		}
+
+		mutex.Lock()
+		streams++
+		first := streams == 1
+		mutex.Unlock()
+
+		froms <- r.URL.Query().Get("from")
+		encoder := json.NewEncoder(w)
+
+		// the first stream skips a change after the snapshot, the next ones are right
+		encoder.Encode(change{Seq: 10, Op: opSnapshot, Snapshot: &snapshot{Tasks: tasks, IdempotencyKeys: map[string]idempotencyRecord{}}})
+
+		if first {
+			encoder.Encode(change{Seq: 12, Op: opPut, Task: &stray})
+		}
+
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	// closed once the replica is stopped, which ends the stream
+	t.Cleanup(primary.Close)
+
+	store := newTestKeyValueStore(t)
+	store.set("databaseShard.0", strings.TrimPrefix(primary.URL, "http://"))
+	replica := startTaskStore(t, store, "TASKSTORE_ROLE=replica")
+
+	// a new replica follows from 0, its own last change
+	if first, second := <-froms, <-froms; first != "0" || second != "-1" {
+		t.Fatalf("followed from %s then %s, expected 0 then a snapshot", first, second)
+	}
+
+	eventually(t, "the replica to resync", func() bool {
+		return replica.status(t).Seq == 10 && reflect.DeepEqual(states(replica.tasks(t)), states(tasks))
+	})
+}
+
+// TestLeaseFailover : a replica takes the expired lease of a primary that stopped, and steps down once another primary holds it
+func TestLeaseFailover(t *testing.T) {
+	store := newTestKeyValueStore(t)
+	primary := startTaskStore(t, store, "TASKSTORE_ROLE=primary", "TASKSTORE_LEASE_TTL=600ms")
+	replica := startTaskStore(t, store, "TASKSTORE_ROLE=replica", "TASKSTORE_LEASE_TTL=600ms")
+	primary.work(t, 4)
+	converged(t, primary, replica)
+	before := replica.tasks(t)
+
+	if holder := parseLease(store.get("databaseLease.0")); holder != primary.address {
+		t.Fatalf("the lease is held by %q, expected the primary %s", holder, primary.address)
+	}
+
+	// the primary stops renewing its lease
+	primary.stop()
+
+	eventually(t, "the replica to be promoted", func() bool {
+		return replica.status(t).Role == rolePrimary
+	})
+
+	if address := store.get("databaseShard.0"); address != replica.address {
+		t.Fatalf("the shard is registered at %q, expected the promoted replica %s", address, replica.address)
+	}
+
+	if tasks := replica.tasks(t); !reflect.DeepEqual(tasks, before) {
+		t.Fatalf("the promoted replica lost tasks: %+v, had %+v", tasks, before)
+	}
+
+	replica.post(t, "/newTask?callback=")
+
+	// another primary takes over, the former replica has to drop what it did since it was promoted
+	other := startTaskStore(t, store, "TASKSTORE_ROLE=primary")
+	store.set("databaseLease.0", other.address+"|"+strconv.FormatInt(time.Now().Add(time.Minute).UnixNano(), 10))
+	other.work(t, 2)
+
+	eventually(t, "the promoted replica to be demoted", func() bool {
+		return replica.status(t).Role == roleReplica
+	})
+
+	converged(t, other, replica)
+}
+
+// TestPromote : without leases, a replica is only promoted through /promote
+func TestPromote(t *testing.T) {
+	store := newTestKeyValueStore(t)
+	primary := startTaskStore(t, store, "TASKSTORE_ROLE=primary")
+	replica := startTaskStore(t, store, "TASKSTORE_ROLE=replica")
+	primary.work(t, 2)
+	converged(t, primary, replica)
+	primary.stop()
+
+	time.Sleep(200 * time.Millisecond)
+
+	if status := replica.status(t); status.Role != roleReplica {
+		t.Fatalf("promoted without a lease: %+v", status)
+	}
+
+	replica.post(t, "/promote")
+
+	if status := replica.status(t); status.Role != rolePrimary || store.get("databaseShard.0") != replica.address {
+		t.Fatalf("not promoted: %+v, the shard at %q", status, store.get("databaseShard.0"))
+	}
+
+	replica.post(t, "/newTask?callback=")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+var throughput *throughputCounter
+
+/*
+throughputCounter :
+Counts the tasks done in each second of a sliding window,
+slots are reused as the window moves on
+*/
+type throughputCounter struct {
+	slots   []int
+	last    int64 // the second of the last counted task
+	started int64
+	mutex   sync.Mutex
+}
+
+func initThroughput(window time.Duration) {
+	seconds := int(window / time.Second)
+
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	now := time.Now().Unix()
+	throughput = &throughputCounter{slots: make([]int, seconds), last: now, started: now}
+}
+
+// advance : empties the slots of the seconds since the last call, must be called with the mutex held
+func (counter *throughputCounter) advance(now int64) {
+	size := int64(len(counter.slots))
+
+	for second := counter.last + 1; second <= now && second <= counter.last+size; second++ {
+		counter.slots[second%size] = 0
+	}
+
+	if now > counter.last {
+		counter.last = now
+	}
+}
+
+func (counter *throughputCounter) record() {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	now := time.Now().Unix()
+	counter.advance(now)
+	counter.slots[now%int64(len(counter.slots))]++
+}
+
+// perSecond : the tasks done per second over the window, or since the start when it is more recent
+func (counter *throughputCounter) perSecond() float64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	now := time.Now().Unix()
+	counter.advance(now)
+
+	done := 0
+
+	for _, count := range counter.slots {
+		done += count
+	}
+
+	seconds := now - counter.started + 1
+
+	if seconds > int64(len(counter.slots)) {
+		seconds = int64(len(counter.slots))
+	}
+
+	return float64(done) / float64(seconds)
+}
+
+// queueStats : the queued and in progress tasks, and how long they should take, as a task.QueueStats
+func queueStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	stats := task.QueueStats{}
+
+	datastoreMutex.RLock()
+	for _, id := range queue {
+		switch datastore[id].State {
+		case task.StatusNotStarted:
+			stats.Queued++
+		case task.StatusInProgress:
+			stats.InProgress++
+		}
+	}
+	datastoreMutex.RUnlock()
+
+	stats.Throughput = throughput.perSecond()
+	stats.EstimatedWait = task.EstimateWait(stats.Queued+stats.InProgress, stats.Throughput)
+
+	response, err := json.Marshal(stats)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+var tenants *tenant.Registry
+
+/*
+ownerOf :
+The tenant the master acts for, from the tenant parameter.
+Empty for workers and operators, who see the tasks of every tenant
+*/
+func ownerOf(r *http.Request) (string, error) {
+	owner := r.URL.Query().Get("tenant")
+
+	if len(owner) == 0 {
+		return "", nil
+	}
+
+	return owner, tenant.ValidateID(owner)
+}
+
+// ownedBy : whether owner may see t, another tenant's task is handled as if it didn't exist
+func ownedBy(t task.Task, owner string) bool {
+	return len(owner) == 0 || t.Tenant == owner
+}
+
+// underConcurrencyQuota : whether a worker may start t, given the tasks in progress of each tenant on this shard
+func underConcurrencyQuota(t task.Task, inProgress map[string]int) bool {
+	owner, ok := tenants.ByID(t.Tenant)
+
+	return !ok || owner.MaxConcurrentTasksPerShard == 0 || inProgress[t.Tenant] < owner.MaxConcurrentTasksPerShard
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/tsauvajon/go-microservices-poc/errorHandling"
+	"github.com/tsauvajon/go-microservices-poc/task"
+)
+
+func idFromQuery(r *http.Request) (string, error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		return "", err
+	}
+
+	id := values.Get("id")
+
+	return id, task.ValidateID(id)
+}
+
+// parentsFinished : must be called with datastoreMutex held
+func parentsFinished(t task.Task) bool {
+	for _, parent := range t.DependsOn {
+		if datastore[parent].State != task.StatusFinished {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cancelDescendants : cancels every task depending directly or indirectly on id,
+// must be called with datastoreMutex held
+func cancelDescendants(id string) {
+	parents := []string{id}
+
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+
+		for childID, child := range datastore {
+			if child.IsDone() || !dependsOn(child, parent) {
+				continue
+			}
+
+			fmt.Println("cancelling task", childID, "because task", parent, "did not finish")
+			child.State = task.StatusCancelled
+			putTask(child)
+			parents = append(parents, childID)
+		}
+	}
+}
+
+func dependsOn(t task.Task, parent string) bool {
+	for _, id := range t.DependsOn {
+		if id == parent {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+endTask :
+Moves a task that isn't done yet to state (failed or cancelled),
+and cancels the tasks waiting for it
+*/
+func endTask(id, owner string, state int, allowedStates ...int) error {
+	datastoreMutex.Lock()
+	defer datastoreMutex.Unlock()
+
+	t, ok := datastore[id]
+
+	if !ok || !ownedBy(t, owner) {
+		return errors.New("This ID does not exist")
+	}
+
+	allowed := false
+
+	for _, allowedState := range allowedStates {
+		if t.State == allowedState {
+			allowed = true
+		}
+	}
+
+	if !allowed {
+		return errors.New("wrong input")
+	}
+
+	t.State = state
+	putTask(t)
+	cancelDescendants(id)
+
+	return nil
+}
+
+func failTask(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("failTask")
+
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	id, err := idFromQuery(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	err = endTask(id, "", task.StatusFailed, task.StatusInProgress)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, "Success")
+}
+
+func cancelTask(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("cancelTask")
+
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	id, err := idFromQuery(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	owner, err := ownerOf(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	err = endTask(id, owner, task.StatusCancelled, task.StatusNotStarted, task.StatusInProgress)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, "Success")
+}
+
+func newWorkflow(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("newWorkflow")
+
+	if r.Method != http.MethodPost {
+		errorHandling.RespondOnlyXAccepted(w, "POST")
+		return
+	}
+
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	request := task.WorkflowRequest{}
+
+	err = json.Unmarshal(data, &request)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	steps, err := request.SortSteps()
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	owner, err := ownerOf(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	datastoreMutex.Lock()
+
+	created := task.WorkflowCreated{
+		ID:    ids.New(),
+		Tasks: make(map[string]string),
+	}
+
+	// parents are always created before their children
+	for _, step := range steps {
+		taskToAdd := task.Task{
+			Name:       step.Name,
+			WorkflowID: created.ID,
+			Tenant:     owner,
+		}
+
+		// validated by the master
+		if step.Spec != nil {
+			taskToAdd.Type = step.Spec.Type
+			taskToAdd.Operations = step.Spec.Operations
+			taskToAdd.Thumbnails = step.Spec.Thumbnails
+			taskToAdd.Output = step.Spec.Output
+		}
+
+		for _, parent := range step.DependsOn {
+			taskToAdd.DependsOn = append(taskToAdd.DependsOn, created.Tasks[parent])
+		}
+
+		created.Tasks[step.Name] = addTask(taskToAdd).ID
+	}
+
+	datastoreMutex.Unlock()
+
+	response, err := json.Marshal(created)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+func getWorkflow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorHandling.RespondOnlyXAccepted(w, "GET")
+		return
+	}
+
+	id, err := idFromQuery(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	owner, err := ownerOf(r)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	workflow := task.Workflow{
+		ID:     id,
+		Counts: make(map[int]int),
+	}
+
+	datastoreMutex.RLock()
+	workflow.Tasks = findTasks(func(t task.Task) bool {
+		return t.WorkflowID == id && ownedBy(t, owner)
+	})
+	datastoreMutex.RUnlock()
+
+	for _, t := range workflow.Tasks {
+		workflow.Counts[t.State]++
+	}
+
+	if len(workflow.Tasks) == 0 {
+		errorHandling.RespondWithError(w, "This workflow does not exist")
+		return
+	}
+
+	workflow.State = task.AggregateState(workflow.Tasks)
+
+	response, err := json.Marshal(workflow)
+
+	if err != nil {
+		errorHandling.RespondWithErrorStack(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
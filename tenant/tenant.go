@@ -0,0 +1,133 @@
+package tenant
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"regexp"
+)
+
+// APIKeyHeader : header carrying the API key of a tenant, or the service key
+const APIKeyHeader = "X-API-Key"
+
+var validID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Tenant : an account whose tasks and images are only visible with its API key, a zero quota disables it
+type Tenant struct {
+	ID     string `json:"id"`
+	APIKey string `json:"apiKey"`
+	// tasks of the tenant in progress at once on each taskStore shard, extra tasks wait in the queue
+	MaxConcurrentTasksPerShard int `json:"maxConcurrentTasksPerShard"`
+	// tasks of the tenant not started yet, new tasks are refused beyond
+	MaxQueuedTasks int `json:"maxQueuedTasks"`
+	// bytes of images of the tenant in the fileStorage, new images are refused beyond
+	MaxStoredBytes int64 `json:"maxStoredBytes"`
+}
+
+/*
+Registry :
+The tenants, read from a JSON file shared by every service:
+
+	{"serviceKey": "...", "tenants": [{"id": "acme", "apiKey": "...", "maxQueuedTasks": 100}]}
+
+The service key is the one of workers and operators, who see every tenant
+*/
+type Registry struct {
+	ServiceKey string   `json:"serviceKey"`
+	Tenants    []Tenant `json:"tenants"`
+
+	byID     map[string]Tenant
+	byAPIKey map[string]Tenant
+}
+
+// ValidateID : tenant IDs end up in file paths, so only a few characters are allowed
+func ValidateID(id string) error {
+	if !validID.MatchString(id) {
+		return errors.New("invalid tenant: " + id)
+	}
+
+	return nil
+}
+
+// Load : reads the registry at path, an empty path gives a registry without tenants
+func Load(path string) (*Registry, error) {
+	registry := &Registry{}
+
+	if len(path) != 0 {
+		data, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// a misspelled or renamed quota would silently mean no limit
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+
+		if err = decoder.Decode(registry); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(registry.Tenants) != 0 && len(registry.ServiceKey) == 0 {
+		return nil, errors.New("the tenants file needs a serviceKey")
+	}
+
+	registry.byID = make(map[string]Tenant)
+	registry.byAPIKey = make(map[string]Tenant)
+
+	for _, t := range registry.Tenants {
+		if err := ValidateID(t.ID); err != nil {
+			return nil, err
+		}
+
+		if len(t.APIKey) == 0 || t.APIKey == registry.ServiceKey {
+			return nil, errors.New("tenant " + t.ID + " needs its own apiKey")
+		}
+
+		if _, exists := registry.byID[t.ID]; exists {
+			return nil, errors.New("duplicate tenant: " + t.ID)
+		}
+
+		if _, exists := registry.byAPIKey[t.APIKey]; exists {
+			return nil, errors.New("duplicate apiKey for tenant " + t.ID)
+		}
+
+		registry.byID[t.ID] = t
+		registry.byAPIKey[t.APIKey] = t
+	}
+
+	return registry, nil
+}
+
+// Enabled : without tenants, every request sees everything
+func (registry *Registry) Enabled() bool {
+	return len(registry.Tenants) != 0
+}
+
+// ByID : the tenant id, ok is false for an unknown tenant
+func (registry *Registry) ByID(id string) (t Tenant, ok bool) {
+	t, ok = registry.byID[id]
+
+	return t, ok
+}
+
+/*
+Authenticate :
+The tenant owning apiKey. The service key, or any request when there are no tenants,
+gives the zero Tenant, whose empty ID means every tenant
+*/
+func (registry *Registry) Authenticate(apiKey string) (Tenant, error) {
+	if !registry.Enabled() || apiKey == registry.ServiceKey {
+		return Tenant{}, nil
+	}
+
+	t, ok := registry.byAPIKey[apiKey]
+
+	if !ok {
+		return Tenant{}, errors.New("missing or invalid " + APIKeyHeader)
+	}
+
+	return t, nil
+}
@@ -5,30 +5,41 @@ import (
 	"image"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 
 	"time"
 
 	"net/http"
+	"net/url"
 
 	"encoding/json"
+	"io"
 	"io/ioutil"
 
-	"image/color"
-	"image/png"
-
 	"bytes"
 
 	"errors"
 
+	"github.com/tsauvajon/go-microservices-poc/config"
 	"github.com/tsauvajon/go-microservices-poc/dataAccess"
+	"github.com/tsauvajon/go-microservices-poc/imageProcessing"
+	"github.com/tsauvajon/go-microservices-poc/plugins"
 	"github.com/tsauvajon/go-microservices-poc/task"
+	"github.com/tsauvajon/go-microservices-poc/tenant"
+)
+
+var (
+	errInvalidImage   = errors.New("the input image can't be decoded")
+	errMissingOverlay = errors.New("an overlay image is missing or can't be decoded")
 )
 
 var (
 	masterLocation       string
 	storageLocation      string
 	keyValueStoreAddress string
+	// the service key of the tenants file, when the master has tenants
+	serviceKey = config.GetString("WORKER_API_KEY", "")
 )
 
 func main() {
@@ -57,6 +68,21 @@ func main() {
 		return
 	}
 
+	// goroutines working on each image, on top of the threads working on different images
+	imageProcessing.SetParallelism(config.GetInt("WORKER_IMAGE_PARALLELISM", 0))
+
+	// operations of the plugin directory, run as executables or WebAssembly modules
+	names, err := plugins.Load(config.GetString("WORKER_PLUGIN_DIRECTORY", ""))
+
+	if err != nil {
+		fmt.Println("Error: ", "can't load the plugins", err.Error())
+		return
+	}
+
+	if len(names) != 0 {
+		fmt.Println("Plugins:", strings.Join(names, ", "))
+	}
+
 	threadCount, err := strconv.Atoi(os.Args[2])
 
 	if err != nil {
@@ -67,10 +93,19 @@ func main() {
 	waitGroup := sync.WaitGroup{}
 	waitGroup.Add(threadCount)
 
+	hostname, err := os.Hostname()
+
+	if err != nil {
+		hostname = "worker"
+	}
+
 	for i := 0; i < threadCount; i++ {
+		// identifies the worker in the task list
+		name := hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + strconv.Itoa(i)
+
 		go func() {
 			for {
-				task, err := getNewTask(masterLocation)
+				task, err := getNewTask(masterLocation, name)
 
 				if err != nil {
 					fmt.Println("Error: ", err)
@@ -79,7 +114,35 @@ func main() {
 					continue
 				}
 
-				img, err := getImageFromStorage(storageLocation, task)
+				// an invalid spec would fail again with any worker
+				if err = imageProcessing.ValidateSpec(task.Spec()); err != nil {
+					fmt.Println("Error: ", "task", task.ID, "can't be processed:", err)
+					registerTaskFailed(masterLocation, task)
+					continue
+				}
+
+				source, err := getImageFromStorage(storageLocation, task)
+
+				if err == errInvalidImage {
+					fmt.Println("Error: ", "task", task.ID, "can't be processed:", err)
+					registerTaskFailed(masterLocation, task)
+					continue
+				}
+
+				if err != nil {
+					fmt.Println("Error: ", err)
+					fmt.Println("2s timeout")
+					time.Sleep(time.Second * 2)
+					continue
+				}
+
+				overlays, err := getOverlaysFromStorage(storageLocation, task)
+
+				if err == errMissingOverlay {
+					fmt.Println("Error: ", "task", task.ID, "can't be processed:", err)
+					registerTaskFailed(masterLocation, task)
+					continue
+				}
 
 				if err != nil {
 					fmt.Println("Error: ", err)
@@ -88,9 +151,22 @@ func main() {
 					continue
 				}
 
-				img = doWorkOnImage(img)
+				// an animated GIF is worked on frame by frame, unless its result is a still image
+				task.Output = imageProcessing.OutputOf(task.Output, source.Image)
+
+				if format, err := imageProcessing.FormatOf(task.Output); err == nil && !format.Animated {
+					source.Image = imageProcessing.Still(source.Image)
+				}
 
-				err = sendImageToStorage(storageLocation, task, img)
+				img, err := doWork(source.Image, task, overlays)
+
+				if err != nil {
+					fmt.Println("Error: ", "task", task.ID, "can't be processed:", err)
+					registerTaskFailed(masterLocation, task)
+					continue
+				}
+
+				err = sendResults(storageLocation, task, img, metadataOf(task, source))
 
 				if err != nil {
 					fmt.Println("Error: ", err)
@@ -99,7 +175,7 @@ func main() {
 					continue
 				}
 
-				err = registerTaskFinished(masterLocation, task)
+				err = registerTaskFinished(masterLocation, task, source.Info)
 
 				if err != nil {
 					fmt.Println("Error: ", err)
@@ -114,15 +190,27 @@ func main() {
 	waitGroup.Wait()
 }
 
-func getNewTask(masterAddress string) (task.Task, error) {
+// postToMaster : the endpoints of the master for workers need the service key
+func postToMaster(address string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodPost, address, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set(tenant.APIKeyHeader, serviceKey)
+
+	return http.DefaultClient.Do(request)
+}
+
+func getNewTask(masterAddress, name string) (task.Task, error) {
 	fmt.Println("Getting new task from", "http://"+masterAddress+"/getNewTask")
 
-	response, err := http.Post("http://"+masterAddress+"/getNewTask", "text/plain", nil)
+	response, err := postToMaster("http://"+masterAddress+"/getNewTask?worker="+url.QueryEscape(name), nil)
 
 	if err != nil {
 		fmt.Println("Error: ", "getNewTask => http.Post", err.Error())
 		return task.Task{
-			ID:    -1,
 			State: -1,
 		}, err
 	}
@@ -130,7 +218,6 @@ func getNewTask(masterAddress string) (task.Task, error) {
 	if response.StatusCode != http.StatusOK {
 		fmt.Println("Error: ", "getNewTask => http.Post", response.Status)
 		return task.Task{
-			ID:    -1,
 			State: -1,
 		}, err
 	}
@@ -141,7 +228,6 @@ func getNewTask(masterAddress string) (task.Task, error) {
 	if err != nil {
 		fmt.Println("Error: ", "getNewTask => ioutil.ReadAll", err.Error())
 		return task.Task{
-			ID:    -1,
 			State: -1,
 		}, err
 	}
@@ -155,7 +241,13 @@ func getNewTask(masterAddress string) (task.Task, error) {
 	if err != nil {
 		fmt.Println("Error: ", "getNewTask => json.Unmarshal", err.Error())
 		return task.Task{
-			ID:    -1,
+			State: -1,
+		}, err
+	}
+
+	if err = task.ValidateID(t.ID); err != nil {
+		fmt.Println("Error: ", "getNewTask => task.ValidateID", err.Error())
+		return task.Task{
 			State: -1,
 		}, err
 	}
@@ -165,63 +257,180 @@ func getNewTask(masterAddress string) (task.Task, error) {
 	return t, nil
 }
 
-func getImageFromStorage(storageAddress string, t task.Task) (image.Image, error) {
-	response, err := http.Get("http://" + storageAddress + "/getImage?state=working&id=" + strconv.Itoa(t.ID))
+/*
+inputOf :
+A task's input is the image uploaded for it, or, in a workflow,
+the result of the first task it depends on
+*/
+func inputOf(t task.Task) (id string, variant string) {
+	if len(t.DependsOn) > 0 {
+		return t.DependsOn[0], task.VariantResult
+	}
+
+	return t.ID, task.VariantOriginal
+}
+
+// getImageFromStorage : the input of the task, turned upright as its EXIF orientation tells
+func getImageFromStorage(storageAddress string, t task.Task) (imageProcessing.Source, error) {
+	id, variant := inputOf(t)
+
+	response, err := http.Get("http://" + storageAddress + "/getImage?id=" + id + "&variant=" + variant + "&tenant=" + t.Tenant)
 
 	if err != nil {
 		fmt.Println("Error: ", "getImageFromStorage => http.Get", err.Error())
-		return nil, err
+		return imageProcessing.Source{}, err
 	}
 
+	defer response.Body.Close()
+
 	if response.StatusCode != http.StatusOK {
 		fmt.Println("Error: ", "getImageFromStorage => http.Get", response.Status)
-		return nil, err
+		return imageProcessing.Source{}, errors.New("Error: " + "unexpected response => " + response.Status)
+	}
+
+	// the EXIF metadata is read from the same bytes as the image
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		fmt.Println("Error: ", "getImageFromStorage => ioutil.ReadAll", err.Error())
+		return imageProcessing.Source{}, err
 	}
 
-	// img, err := png.Decode(response.Body)
+	// any format with a registered decoder, found from the first bytes
+	source, err := imageProcessing.Open(data)
 
-	// if err != nil {
-	// 	return nil, err
-	// }
+	if err != nil {
+		fmt.Println("Error: ", "getImageFromStorage => imageProcessing.Open", err.Error())
+		return imageProcessing.Source{}, errInvalidImage
+	}
 
-	// return img, nil
+	return source, nil
+}
 
-	return png.Decode(response.Body)
+// metadataOf : the EXIF metadata to write in the results of the task, none unless it preserves it
+func metadataOf(t task.Task, source imageProcessing.Source) *imageProcessing.Exif {
+	if t.Output.Metadata != task.MetadataPreserve {
+		return nil
+	}
+
+	return source.Exif
 }
 
-// invert reds and greens
-func doWorkOnImage(img image.Image) image.Image {
-	canvas := image.NewRGBA(img.Bounds())
-
-	for i := 0; i < canvas.Rect.Max.X; i++ {
-		for j := 0; j < canvas.Rect.Max.Y; j++ {
-			r, g, b, a := img.At(i, j).RGBA()
-			color := new(color.RGBA)
-			color.R = uint8(g)
-			color.G = uint8(r)
-			color.B = uint8(b)
-			color.A = uint8(a)
-			canvas.Set(i, j, color)
+// the work done on the tasks without operations
+var defaultOperations = []task.Operation{{Name: "swapRedGreen"}}
+
+// getOverlaysFromStorage : the overlay images the operations of the task use, fetched once each
+func getOverlaysFromStorage(storageAddress string, t task.Task) (imageProcessing.Overlays, error) {
+	overlays := make(map[string]image.Image)
+
+	for _, name := range imageProcessing.OverlaysOf(t.Operations) {
+		if _, fetched := overlays[name]; fetched {
+			continue
+		}
+
+		response, err := http.Get("http://" + storageAddress + "/getOverlay?name=" + name + "&tenant=" + t.Tenant)
+
+		if err != nil {
+			fmt.Println("Error: ", "getOverlaysFromStorage => http.Get", err.Error())
+			return nil, err
+		}
+
+		// deleted since the task was created
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			fmt.Println("Error: ", "getOverlaysFromStorage => http.Get", response.Status)
+			return nil, errMissingOverlay
+		}
+
+		overlays[name], _, err = imageProcessing.Decode(response.Body)
+		response.Body.Close()
+
+		if err != nil {
+			fmt.Println("Error: ", "getOverlaysFromStorage => imageProcessing.Decode", err.Error())
+			return nil, errMissingOverlay
+		}
+	}
+
+	return func(name string) (image.Image, error) {
+		overlay, exists := overlays[name]
+
+		if !exists {
+			return nil, errors.New("no overlay " + name)
+		}
+
+		return overlay, nil
+	}, nil
+}
+
+// doWork : applies the operations of the task
+func doWork(img image.Image, t task.Task, overlays imageProcessing.Overlays) (image.Image, error) {
+	if len(t.Operations) == 0 {
+		return imageProcessing.Run(img, defaultOperations)
+	}
+
+	return imageProcessing.RunWith(img, t.Operations, overlays)
+}
+
+// sendResults : stores img as the result of the task, then resized to each size of a thumbnails task, all with metadata
+func sendResults(storageAddress string, t task.Task, img image.Image, metadata *imageProcessing.Exif) error {
+	if err := sendImageToStorage(storageAddress, t, task.VariantResult, img, metadata); err != nil {
+		return err
+	}
+
+	if t.Type != task.TypeThumbnails {
+		return nil
+	}
+
+	for _, thumbnail := range t.Sizes() {
+		resized, err := imageProcessing.Run(img, []task.Operation{thumbnail.Resize()})
+
+		if err != nil {
+			fmt.Println("Error: ", "sendResults => imageProcessing.Run", err.Error())
+			return err
+		}
+
+		if err = sendImageToStorage(storageAddress, t, thumbnail.Name(), resized, metadata); err != nil {
+			return err
 		}
 	}
 
-	return canvas.SubImage(img.Bounds())
+	return nil
 }
 
-func sendImageToStorage(storageAddress string, t task.Task, img image.Image) error {
+// sendImageToStorage : stores the result of the task, or another variant of its images, with the EXIF metadata if any
+func sendImageToStorage(storageAddress string, t task.Task, variant string, img image.Image, metadata *imageProcessing.Exif) error {
 	data := []byte{}
 	buffer := bytes.NewBuffer(data)
 
-	err := png.Encode(buffer, img)
+	format, err := imageProcessing.FormatOf(t.Output)
 
 	if err != nil {
-		fmt.Println("Error: ", "sendImageToStorage => png.Encode", err.Error())
+		fmt.Println("Error: ", "sendImageToStorage => imageProcessing.FormatOf", err.Error())
 		return err
 	}
 
-	id := strconv.Itoa(t.ID)
+	err = format.Encode(buffer, img, t.Output.Quality)
+
+	if err != nil {
+		fmt.Println("Error: ", "sendImageToStorage => format.Encode", err.Error())
+		return err
+	}
 
-	response, err := http.Post("http://"+storageAddress+"/sendImage?state=finished&id="+id, "image/png", buffer)
+	if metadata != nil && format.Embed != nil {
+		// img is already upright
+		embedded, err := format.Embed(buffer.Bytes(), metadata.Upright(img.Bounds().Size()))
+
+		if err != nil {
+			fmt.Println("Error: ", "sendImageToStorage => format.Embed", err.Error())
+			return err
+		}
+
+		buffer = bytes.NewBuffer(embedded)
+	}
+
+	id := t.ID
+
+	response, err := http.Post("http://"+storageAddress+"/sendImage?id="+id+"&variant="+variant+"&tenant="+t.Tenant, format.ContentType, buffer)
 
 	if err != nil {
 		fmt.Println("Error: ", "sendImageToStorage => http.Post", err.Error())
@@ -235,11 +444,19 @@ func sendImageToStorage(storageAddress string, t task.Task, img image.Image) err
 	return nil
 }
 
-func registerTaskFinished(masterAddress string, t task.Task) error {
-	id := strconv.Itoa(t.ID)
+// registerTaskFinished : reports the task done, along with what was found out about its input
+func registerTaskFinished(masterAddress string, t task.Task, info task.ImageInfo) error {
+	id := t.ID
+
+	body, err := json.Marshal(info)
+
+	if err != nil {
+		fmt.Println("Error: ", "registerTaskFinished => json.Marshal", err.Error())
+		return err
+	}
 
 	fmt.Println("registerTaskFinished on", "http://"+masterAddress+"/registerTaskFinished?id="+id)
-	response, err := http.Post("http://"+masterAddress+"/registerTaskFinished?id="+id, "text/plain", nil)
+	response, err := postToMaster("http://"+masterAddress+"/registerTaskFinished?id="+id, bytes.NewReader(body))
 
 	if err != nil {
 		fmt.Println("Error: ", "registerTaskFinished => http.Post", err.Error())
@@ -252,3 +469,21 @@ func registerTaskFinished(masterAddress string, t task.Task) error {
 
 	return nil
 }
+
+func registerTaskFailed(masterAddress string, t task.Task) error {
+	id := t.ID
+
+	fmt.Println("registerTaskFailed on", "http://"+masterAddress+"/registerTaskFailed?id="+id)
+	response, err := postToMaster("http://"+masterAddress+"/registerTaskFailed?id="+id, nil)
+
+	if err != nil {
+		fmt.Println("Error: ", "registerTaskFailed => http.Post", err.Error())
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return errors.New("Error: " + "unexpected response => " + response.Status)
+	}
+
+	return nil
+}